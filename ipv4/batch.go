@@ -0,0 +1,142 @@
+package ipv4
+
+// trieMatcher finds the longest match for a sequence of addresses. It keeps
+// the path from the root to the deepest node containing the last address so
+// that the next lookup only needs to back up to the first node on the path
+// which contains it. When the addresses are sorted, consecutive lookups share
+// most of their path and very few nodes are visited for each one. It still
+// gives correct results for unsorted addresses.
+type trieMatcher struct {
+	root *trieNode
+
+	// path[i] is the i-th node from the root containing the last address and
+	// best[i] is the longest active node in path[:i+1]. A prefix length can
+	// only increase along a path so it can't have more than 33 nodes.
+	path  [33]*trieNode
+	best  [33]*trieNode
+	depth int
+}
+
+// containsAddress returns true if the node's prefix contains the address
+func (me *trieNode) containsAddress(address Address) bool {
+	mask := uint32(0xffffffff) << (32 - me.Prefix.length)
+	return (me.Prefix.addr.ui^address.ui)&mask == 0
+}
+
+// child returns the child of the node which would contain the address
+func (me *trieNode) child(address Address) *trieNode {
+	if me.Prefix.length == 32 {
+		return nil
+	}
+	return me.children[(address.ui>>(31-me.Prefix.length))&1]
+}
+
+// match returns the active node with the longest prefix containing the given
+// address or nil if there isn't one
+func (me *trieMatcher) match(address Address) *trieNode {
+	for me.depth > 0 && !me.path[me.depth-1].containsAddress(address) {
+		me.depth--
+	}
+
+	node, best := me.root, (*trieNode)(nil)
+	if me.depth > 0 {
+		node = me.path[me.depth-1].child(address)
+		best = me.best[me.depth-1]
+	}
+	for node != nil && node.containsAddress(address) {
+		if node.isActive {
+			best = node
+		}
+		me.path[me.depth] = node
+		me.best[me.depth] = best
+		me.depth++
+		node = node.child(address)
+	}
+	return best
+}
+
+// TableXMatch is the result of a longest prefix match for one address. Value
+// and Prefix should be ignored if Found is false.
+type TableXMatch struct {
+	Value  interface{}
+	Found  bool
+	Prefix Prefix
+}
+
+// LongestMatchBatch finds the longest match, like LongestMatch, for each of
+// the given addresses. It appends the results, in the same order as the
+// addresses, to out and returns the extended slice. It doesn't allocate if out
+// has enough capacity so out[:0] from a previous call can be reused.
+//
+// It is much faster than calling LongestMatch for each address, especially
+// when they are sorted, because it reuses the traversal of the table from one
+// address to the next. They don't need to be sorted.
+func (me TableX) LongestMatchBatch(addresses []Address, out []TableXMatch) []TableXMatch {
+	matcher := trieMatcher{root: me.trie}
+	for _, address := range addresses {
+		if node := matcher.match(address); node != nil {
+			out = append(out, TableXMatch{node.Data, true, node.Prefix})
+		} else {
+			out = append(out, TableXMatch{})
+		}
+	}
+	return out
+}
+
+// setMatcher is like trieMatcher but for a set. Since a set is flat, the
+// first active node found containing an address is the only match.
+type setMatcher struct {
+	root  *setNode
+	path  [33]*setNode
+	depth int
+}
+
+// containsAddress returns true if the node's prefix contains the address
+func (me *setNode) containsAddress(address Address) bool {
+	mask := uint32(0xffffffff) << (32 - me.Prefix.length)
+	return (me.Prefix.addr.ui^address.ui)&mask == 0
+}
+
+// match returns true if the set contains the given address
+func (me *setMatcher) match(address Address) bool {
+	for me.depth > 0 && !me.path[me.depth-1].containsAddress(address) {
+		me.depth--
+	}
+
+	node := me.root
+	if me.depth > 0 {
+		top := me.path[me.depth-1]
+		if top.isActive {
+			return true
+		}
+		if top.isBitmap {
+			return top.bitmap().test(address.ui & 0xff)
+		}
+		node = top.children[(address.ui>>(31-top.Prefix.length))&1]
+	}
+	for node != nil && node.containsAddress(address) {
+		me.path[me.depth] = node
+		me.depth++
+		if node.isActive {
+			return true
+		}
+		if node.isBitmap {
+			return node.bitmap().test(address.ui & 0xff)
+		}
+		node = node.children[(address.ui>>(31-node.Prefix.length))&1]
+	}
+	return false
+}
+
+// ContainsBatch tests whether each of the given addresses is contained in the
+// set. It appends the results, in the same order as the addresses, to out and
+// returns the extended slice. Like LongestMatchBatch, it reuses the traversal
+// of the set from one address to the next, which is fastest when the
+// addresses are sorted.
+func (me Set) ContainsBatch(addresses []Address, out []bool) []bool {
+	matcher := setMatcher{root: me.trie}
+	for _, address := range addresses {
+		out = append(out, matcher.match(address))
+	}
+	return out
+}
@@ -0,0 +1,178 @@
+package ipv4
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLongestMatchBatch(t *testing.T) {
+	m := NewTableX_()
+	for i, p := range []string{
+		"0.0.0.0/0",
+		"10.0.0.0/8",
+		"10.0.1.0/24",
+		"10.0.1.128/25",
+		"10.0.1.200/32",
+		"192.168.0.0/23",
+		"255.255.255.255/32",
+	} {
+		m.Insert(_p(p), i)
+	}
+	table := m.Table()
+
+	addresses := []Address{
+		_a("10.0.1.201"),
+		_a("10.0.1.200"),
+		_a("10.0.1.1"),
+		_a("1.2.3.4"),
+		_a("255.255.255.255"),
+		_a("10.0.1.200"),
+		_a("192.168.1.1"),
+		_a("10.0.1.130"),
+	}
+	matches := table.LongestMatchBatch(addresses, nil)
+	assert.Len(t, matches, len(addresses))
+	for i, a := range addresses {
+		value, found, prefix := table.LongestMatch(a)
+		assert.Equal(t, TableXMatch{value, found, prefix}, matches[i], a.String())
+	}
+
+	// Results are appended
+	matches = table.LongestMatchBatch(addresses[:1], matches[:2])
+	assert.Len(t, matches, 3)
+	assert.Equal(t, matches[0], matches[2])
+
+	assert.Equal(t, 0.0, testing.AllocsPerRun(10, func() {
+		table.LongestMatchBatch(addresses, matches[:0])
+	}))
+
+	matches = TableX{}.LongestMatchBatch(addresses[:2], nil)
+	assert.Equal(t, []TableXMatch{{}, {}}, matches)
+}
+
+func TestLongestMatchBatchRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(40))
+	m := NewTableX_()
+	for i := 0; i < 1000; i++ {
+		address := Address{0x0a000000 | r.Uint32()&0x0000ffff}
+		m.Insert(Prefix{address, uint32(8 + r.Intn(25))}.Network(), i)
+	}
+	table := m.Table()
+
+	addresses := make([]Address, 5000)
+	for i := range addresses {
+		addresses[i] = Address{0x0a000000 | r.Uint32()&0x0001ffff}
+	}
+	check := func() {
+		matches := table.LongestMatchBatch(addresses, nil)
+		for i, a := range addresses {
+			value, found, prefix := table.LongestMatch(a)
+			assert.Equal(t, TableXMatch{value, found, prefix}, matches[i])
+		}
+	}
+	check()
+	sort.Slice(addresses, func(i, j int) bool {
+		return addresses[i].lessThan(addresses[j])
+	})
+	check()
+}
+
+func TestContainsBatch(t *testing.T) {
+	set := _p("10.0.0.0/24").Set().
+		Union(_r(_a("10.0.1.3"), _a("10.0.1.9"))).
+		Union(_a("255.255.255.255"))
+
+	addresses := []Address{
+		_a("9.255.255.255"),
+		_a("10.0.0.0"),
+		_a("10.0.0.255"),
+		_a("10.0.1.2"),
+		_a("10.0.1.3"),
+		_a("10.0.1.9"),
+		_a("10.0.1.10"),
+		_a("255.255.255.255"),
+		_a("10.0.0.7"),
+	}
+	contains := set.ContainsBatch(addresses, nil)
+	for i, a := range addresses {
+		assert.Equal(t, set.Contains(a), contains[i], a.String())
+	}
+
+	assert.Equal(t, []bool{false}, Set{}.ContainsBatch(addresses[1:2], nil))
+	assert.Equal(t, []bool{true, true}, Prefix{}.Set().ContainsBatch(addresses[:2], nil))
+}
+
+// benchmarkAddresses returns n sorted random addresses
+func benchmarkAddresses(r *rand.Rand, n int) []Address {
+	addresses := make([]Address, n)
+	for i := range addresses {
+		addresses[i] = Address{r.Uint32()}
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		return addresses[i].lessThan(addresses[j])
+	})
+	return addresses
+}
+
+// benchmarkTable returns a table with n random entries and n sorted random
+// addresses to look up in it. They are the same every time.
+func benchmarkTable(n int) (TableX, []Address) {
+	r := rand.New(rand.NewSource(40))
+	m := NewTableX_()
+	for _, p := range randomPrefixes(r, n) {
+		m.InsertOrUpdate(p, p.Length())
+	}
+	return m.Table(), benchmarkAddresses(r, n)
+}
+
+// benchmarkSet is like benchmarkTable but returns a set
+func benchmarkSet(n int) (Set, []Address) {
+	r := rand.New(rand.NewSource(40))
+	return SetFromPrefixes(randomPrefixes(r, n)), benchmarkAddresses(r, n)
+}
+
+// Each benchmark runs the batch next to a baseline that looks up the same
+// addresses one at a time
+
+func BenchmarkLongestMatchBatch(b *testing.B) {
+	table, addresses := benchmarkTable(100000)
+	b.Run("LongestMatch", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, a := range addresses {
+				table.LongestMatch(a)
+			}
+		}
+	})
+	b.Run("LongestMatchBatch", func(b *testing.B) {
+		out := make([]TableXMatch, 0, len(addresses))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			out = table.LongestMatchBatch(addresses, out[:0])
+		}
+	})
+}
+
+func BenchmarkContainsBatch(b *testing.B) {
+	set, addresses := benchmarkSet(100000)
+	b.Run("Contains", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, a := range addresses {
+				set.Contains(a)
+			}
+		}
+	})
+	b.Run("ContainsBatch", func(b *testing.B) {
+		out := make([]bool, 0, len(addresses))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			out = set.ContainsBatch(addresses, out[:0])
+		}
+	})
+}
@@ -0,0 +1,291 @@
+package ipv4
+
+import "math/bits"
+
+// bitmapMinPrefixes is the number of prefixes above which the contents of a
+// /24 in a set are stored in a bitmap leaf instead of a subtrie. A subtrie
+// with n prefixes has 2n-1 nodes so, beyond this, a bitmap is a lot smaller.
+const bitmapMinPrefixes = 16
+
+// bitmap holds one bit for each address in a /24. The address at offset i
+// from the start of the /24 is bit i%64 of word i/64.
+type bitmap [4]uint64
+
+func (me *bitmap) set(first, last uint32) {
+	for i := first; i <= last; i++ {
+		me[i/64] |= 1 << (i % 64)
+	}
+}
+
+func (me *bitmap) test(offset uint32) bool {
+	return me[offset/64]&(1<<(offset%64)) != 0
+}
+
+// testRange returns true if all of the bits from first to last are set
+func (me *bitmap) testRange(first, last uint32) bool {
+	for i := first; i <= last; i++ {
+		if !me.test(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// testAny returns true if any of the bits from first to last are set
+func (me *bitmap) testAny(first, last uint32) bool {
+	for i := first; i <= last; i++ {
+		if me.test(i) {
+			return true
+		}
+	}
+	return false
+}
+
+func (me *bitmap) count() int64 {
+	var count int
+	for _, word := range me {
+		count += bits.OnesCount64(word)
+	}
+	return int64(count)
+}
+
+// rank returns the number of bits set before the given offset
+func (me *bitmap) rank(offset uint32) int64 {
+	var count int
+	for i := uint32(0); i < offset/64; i++ {
+		count += bits.OnesCount64(me[i])
+	}
+	if offset%64 != 0 {
+		count += bits.OnesCount64(me[offset/64] << (64 - offset%64))
+	}
+	return int64(count)
+}
+
+// nth returns the offset of the bit set at the given index. The index must be
+// less than count().
+func (me *bitmap) nth(index int64) uint32 {
+	for i, word := range me {
+		if n := int64(bits.OnesCount64(word)); index >= n {
+			index -= n
+			continue
+		}
+		for ; index > 0; index-- {
+			// Clear the lowest bit
+			word &= word - 1
+		}
+		return uint32(i*64 + bits.TrailingZeros64(word))
+	}
+	panic("index out of range")
+}
+
+func (me *bitmap) or(other *bitmap) {
+	for i := range me {
+		me[i] |= other[i]
+	}
+}
+
+func (me *bitmap) and(other *bitmap) {
+	for i := range me {
+		me[i] &= other[i]
+	}
+}
+
+func (me *bitmap) andNot(other *bitmap) {
+	for i := range me {
+		me[i] &^= other[i]
+	}
+}
+
+// walkRanges visits each run of consecutive set bits as a range of addresses
+// in the /24 starting at base
+func (me *bitmap) walkRanges(base uint32, callback func(Range) bool) bool {
+	for i := uint32(0); i < 256; i++ {
+		if !me.test(i) {
+			continue
+		}
+		first := i
+		for i+1 < 256 && me.test(i+1) {
+			i++
+		}
+		if !callback(Range{Address{base + first}, Address{base + i}}) {
+			return false
+		}
+	}
+	return true
+}
+
+// walkPrefixes visits the smallest set of prefixes covering the set bits, in
+// lexigraphical order, as addresses in the /24 starting at base
+func (me *bitmap) walkPrefixes(base uint32, callback func(Prefix) bool) bool {
+	for i := uint32(0); i < 256; i++ {
+		if !me.test(i) {
+			continue
+		}
+		first := i
+		for i+1 < 256 && me.test(i+1) {
+			i++
+		}
+		// Take the largest aligned block from the start of the run until
+		// nothing is left
+		for end := i + 1; first < end; {
+			size := uint32(256)
+			if first != 0 {
+				size = first & -first
+			}
+			for size > end-first {
+				size >>= 1
+			}
+			length := uint32(32 - bits.TrailingZeros32(size))
+			if !callback(Prefix{Address{base + first}, length}) {
+				return false
+			}
+			first += size
+		}
+	}
+	return true
+}
+
+// walkPrefixesReverse is like walkPrefixes but visits the prefixes in exactly
+// the opposite order
+func (me *bitmap) walkPrefixesReverse(base uint32, callback func(Prefix) bool) bool {
+	for i := uint32(256); i > 0; i-- {
+		if !me.test(i - 1) {
+			continue
+		}
+		end := i
+		for i > 1 && me.test(i-2) {
+			i--
+		}
+		// Peel the largest aligned block off of the end of the run until
+		// nothing is left. These are the same prefixes that walkPrefixes
+		// finds from the start.
+		for first := i - 1; end > first; {
+			size := end & -end
+			for size > end-first {
+				size >>= 1
+			}
+			length := uint32(32 - bits.TrailingZeros32(size))
+			if !callback(Prefix{Address{base + end - size}, length}) {
+				return false
+			}
+			end -= size
+		}
+	}
+	return true
+}
+
+// numPrefixes returns the number of prefixes that walkPrefixes visits
+func (me *bitmap) numPrefixes() int64 {
+	var count int64
+	me.walkPrefixes(0, func(Prefix) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+// nthPrefix returns the prefix at the given index in the order that
+// walkPrefixes visits them. The index must be less than numPrefixes().
+func (me *bitmap) nthPrefix(base uint32, index int64) (result Prefix) {
+	me.walkPrefixes(base, func(p Prefix) bool {
+		result = p
+		index--
+		return index >= 0
+	})
+	return result
+}
+
+// rankPrefix returns the number of prefixes that walkPrefixes visits before
+// the first one that doesn't come before the given key in lexigraphical order
+func (me *bitmap) rankPrefix(base uint32, key Prefix) int64 {
+	var count int64
+	me.walkPrefixes(base, func(p Prefix) bool {
+		if !p.lessThan(key) {
+			return false
+		}
+		count++
+		return true
+	})
+	return count
+}
+
+// fillBitmap sets the bits for all of the addresses in this subtrie, which
+// must be contained in a single /24
+func (me *setNode) fillBitmap(b *bitmap) {
+	switch {
+	case me == nil:
+	case me.isBitmap:
+		b.or(me.bitmap())
+	case me.isActive:
+		first := me.Prefix.Network().addr.ui & 0xff
+		b.set(first, first+uint32(me.numAddresses)-1)
+	default:
+		me.children[0].fillBitmap(b)
+		me.children[1].fillBitmap(b)
+	}
+}
+
+// newBitmapLeaf returns a bitmap leaf for the /24 starting at base with a
+// copy of the given bitmap
+func newBitmapLeaf(base uint32, b *bitmap, numPrefixes uint32) *setNode {
+	leaf := &bitmapNode{
+		setNode: setNode{
+			Prefix:       Prefix{Address{base}, 24},
+			numAddresses: uint64(b.count()),
+			size:         numPrefixes,
+			h:            1,
+			isBitmap:     true,
+		},
+		bits: *b,
+	}
+	return &leaf.setNode
+}
+
+// compress returns a bitmap leaf for the /24 to replace the subtrie under
+// this node if it has too many prefixes. Otherwise, it returns the node. It
+// assumes that the node is new and that the counts are up to date.
+func (me *setNode) compress() *setNode {
+	if me.isBitmap || me.isActive || me.Prefix.length < 24 || me.size <= bitmapMinPrefixes {
+		return me
+	}
+	var b bitmap
+	me.fillBitmap(&b)
+	return newBitmapLeaf(me.Prefix.addr.ui&^0xff, &b, me.size)
+}
+
+// setNodeFromBitmap returns the canonical subtrie for the addresses in the /24
+// starting at base that are set in the bitmap
+func setNodeFromBitmap(base uint32, b *bitmap) *setNode {
+	if numPrefixes := b.numPrefixes(); numPrefixes > bitmapMinPrefixes {
+		return newBitmapLeaf(base, b, uint32(numPrefixes))
+	}
+	builder := setBuilder{}
+	b.walkPrefixes(base, func(p Prefix) bool {
+		builder.add(&setNode{Prefix: p})
+		return true
+	})
+	return builder.finish()
+}
+
+// sameBlock returns the base address of the /24 if either node is a bitmap
+// leaf and the other is in the same /24. In that case, an operation on them
+// must be done with bitmaps.
+func sameBlock(a, b *setNode) (base uint32, ok bool) {
+	if !a.isBitmap && !b.isBitmap {
+		return 0, false
+	}
+	if a.Prefix.length < 24 || b.Prefix.length < 24 || a.Prefix.addr.ui>>8 != b.Prefix.addr.ui>>8 {
+		return 0, false
+	}
+	return a.Prefix.addr.ui &^ 0xff, true
+}
+
+// combineBitmaps applies the given operation to the bitmaps of the two nodes,
+// which must be in the same /24, and returns the canonical result
+func combineBitmaps(base uint32, a, b *setNode, op func(a, b *bitmap)) *setNode {
+	var x, y bitmap
+	a.fillBitmap(&x)
+	b.fillBitmap(&y)
+	op(&x, &y)
+	return setNodeFromBitmap(base, &x)
+}
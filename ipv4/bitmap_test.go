@@ -0,0 +1,232 @@
+package ipv4
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countSetNodes counts the nodes actually allocated in the trie
+func countSetNodes(n *setNode) int {
+	if n == nil {
+		return 0
+	}
+	return 1 + countSetNodes(n.children[0]) + countSetNodes(n.children[1])
+}
+
+func countBitmapLeaves(n *setNode) int {
+	if n == nil {
+		return 0
+	}
+	if n.isBitmap {
+		return 1
+	}
+	return countBitmapLeaves(n.children[0]) + countBitmapLeaves(n.children[1])
+}
+
+func TestBitmapLeaf(t *testing.T) {
+	// Every other address in a /24
+	s := NewSet_()
+	for i := 0; i < 256; i += 2 {
+		s.Insert(AddressFromBytes(10, 0, 0, byte(i)))
+	}
+	set := s.Set()
+	assert.True(t, set.isValid())
+	assert.True(t, set.trie.isBitmap)
+	assert.Equal(t, 1, countSetNodes(set.trie))
+	assert.Equal(t, int64(128), set.NumAddresses())
+	assert.Equal(t, int64(128), set.trie.NumNodes())
+
+	var prefixes []Prefix
+	set.WalkPrefixes(func(p Prefix) bool {
+		prefixes = append(prefixes, p)
+		return true
+	})
+	assert.Len(t, prefixes, 128)
+	assert.Equal(t, _p("10.0.0.0/32"), prefixes[0])
+	assert.Equal(t, _p("10.0.0.254/32"), prefixes[127])
+
+	assert.True(t, set.Contains(_a("10.0.0.4")))
+	assert.False(t, set.Contains(_a("10.0.0.5")))
+	assert.False(t, set.Contains(_p("10.0.0.4/31")))
+	assert.False(t, set.Contains(_p("10.0.0.0/24")))
+	assert.NotNil(t, set.trie.Match(_p("10.0.0.4/32")))
+	assert.Nil(t, set.trie.Match(_p("10.0.0.4/31")))
+	assert.Nil(t, set.trie.Match(_p("10.0.0.0/16")))
+
+	// A table can be restricted to it
+	m := NewTableX_()
+	m.Insert(_p("10.0.0.4/32"), 1)
+	m.Insert(_p("10.0.0.5/32"), 2)
+	m.Insert(_p("10.0.0.0/24"), 3)
+	assert.Equal(t, int64(1), m.Table().Restrict(set).NumEntries())
+
+	// Filling in the gaps collapses it into a single prefix
+	s.Insert(_p("10.0.0.0/24"))
+	assert.True(t, s.Set().trie.isActive)
+	assert.False(t, s.Set().trie.isBitmap)
+
+	// Removing most of them goes back to a trie
+	set = set.Difference(_r(_a("10.0.0.0"), _a("10.0.0.239")))
+	assert.True(t, set.isValid())
+	assert.False(t, set.trie.isBitmap)
+	assert.Equal(t, int64(8), set.NumAddresses())
+}
+
+func TestBitmapLeafOperations(t *testing.T) {
+	// A small space where everything can be checked by brute force
+	space := _p("10.0.0.0/22")
+	r := rand.New(rand.NewSource(43))
+
+	randomSet := func() (Set, map[Address]bool) {
+		addresses := map[Address]bool{}
+		s := NewSet_()
+		for i := 0; i < 50+r.Intn(150); i++ {
+			p := Prefix{Address{space.addr.ui + uint32(r.Intn(1024))}, uint32(30 + r.Intn(3))}.Network()
+			s.Insert(p)
+			p.walkAddresses(func(a Address) bool {
+				addresses[a] = true
+				return true
+			})
+		}
+		return s.Set(), addresses
+	}
+
+	check := func(t *testing.T, set Set, expected func(Address) bool) {
+		assert.True(t, set.isValid())
+
+		var count int64
+		space.walkAddresses(func(a Address) bool {
+			if expected(a) {
+				count++
+			}
+			assert.Equal(t, expected(a), set.Contains(a))
+			return true
+		})
+		assert.Equal(t, count, set.NumAddresses())
+
+		// The result is canonical no matter how it is built
+		var prefixes []Prefix
+		set.WalkPrefixes(func(p Prefix) bool {
+			prefixes = append(prefixes, p)
+			return true
+		})
+		assert.Equal(t, int64(len(prefixes)), set.trie.NumNodes())
+		assert.True(t, SetFromPrefixes(prefixes).Equal(set))
+		assert.True(t, set.Freeze().Set().Equal(set))
+
+		for i, p := range prefixes {
+			nth, _ := set.NthPrefix(int64(i))
+			assert.Equal(t, p, nth)
+			assert.Equal(t, int64(i), set.trie.Rank(p))
+		}
+		for j := 0; j < 20; j++ {
+			key := Prefix{Address{space.addr.ui + uint32(r.Intn(1024))}, uint32(22 + r.Intn(11))}.Network()
+			var before int64
+			for _, p := range prefixes {
+				if p.lessThan(key) {
+					before++
+				}
+			}
+			assert.Equal(t, before, set.trie.Rank(key))
+		}
+		var reverse []Prefix
+		set.WalkPrefixesReverse(func(p Prefix) bool {
+			reverse = append([]Prefix{p}, reverse...)
+			return true
+		})
+		assert.Equal(t, prefixes, reverse)
+
+		var i int64
+		set.WalkAddresses(func(a Address) bool {
+			nth, _ := set.Nth(i)
+			assert.Equal(t, a, nth)
+			assert.Equal(t, i, set.Rank(a))
+			i++
+			return true
+		})
+	}
+
+	var bitmaps int
+	for i := 0; i < 10; i++ {
+		a, inA := randomSet()
+		b, inB := randomSet()
+		bitmaps += countBitmapLeaves(a.trie) + countBitmapLeaves(b.trie)
+		t.Run("union", func(t *testing.T) {
+			check(t, a.Union(b), func(x Address) bool { return inA[x] || inB[x] })
+		})
+		t.Run("intersection", func(t *testing.T) {
+			check(t, a.Intersection(b), func(x Address) bool { return inA[x] && inB[x] })
+		})
+		t.Run("difference", func(t *testing.T) {
+			check(t, a.Difference(b), func(x Address) bool { return inA[x] && !inB[x] })
+		})
+		t.Run("contains", func(t *testing.T) {
+			assert.True(t, a.Union(b).Contains(a))
+			assert.True(t, a.Contains(a.Intersection(b)))
+		})
+		t.Run("batch", func(t *testing.T) {
+			var addresses []Address
+			space.walkAddresses(func(x Address) bool {
+				addresses = append(addresses, x)
+				return true
+			})
+			contains := a.ContainsBatch(addresses, nil)
+			for i, x := range addresses {
+				assert.Equal(t, inA[x], contains[i])
+			}
+		})
+	}
+	// Make sure that the test exercised them
+	assert.Greater(t, bitmaps, 10)
+}
+
+func TestSetNodeOverlaps(t *testing.T) {
+	s := NewSet_()
+	for i := 0; i < 256; i += 4 {
+		s.Insert(AddressFromBytes(10, 0, 0, byte(i)))
+	}
+	s.Insert(_p("192.168.0.0/16"))
+	trie := s.Set().trie
+
+	for _, tt := range []struct {
+		prefix   string
+		overlaps bool
+	}{
+		{"0.0.0.0/0", true},
+		{"10.0.0.0/24", true},
+		{"10.0.0.4/32", true},
+		{"10.0.0.4/30", true},
+		{"10.0.0.5/32", false},
+		{"10.0.0.6/31", false},
+		{"10.0.1.0/24", false},
+		{"192.168.3.0/24", true},
+		{"192.0.0.0/8", true},
+		{"172.16.0.0/12", false},
+	} {
+		assert.Equal(t, tt.overlaps, trie.overlaps(_p(tt.prefix)), tt.prefix)
+	}
+	assert.False(t, (*setNode)(nil).overlaps(Prefix{}))
+}
+
+func TestBitmapLeafAllocs(t *testing.T) {
+	// Prefixes in a bitmap leaf are found without expanding it into a trie
+	s := NewSet_()
+	for i := 0; i < 256; i += 2 {
+		s.Insert(AddressFromBytes(10, 0, 0, byte(i)))
+	}
+	set := s.Set()
+	assert.True(t, set.trie.isBitmap)
+
+	assert.LessOrEqual(t, testing.AllocsPerRun(10, func() {
+		set.trie.Nth(100)
+	}), 1.0)
+	key := _p("10.0.0.200/32")
+	assert.LessOrEqual(t, testing.AllocsPerRun(10, func() {
+		set.trie.Rank(key)
+	}), 0.0)
+	assert.LessOrEqual(t, testing.AllocsPerRun(10, func() {
+		set.trie.WalkReverse(func(Prefix) bool { return true })
+	}), 0.0)
+}
@@ -0,0 +1,222 @@
+package ipv4
+
+import (
+	"fmt"
+	"sort"
+)
+
+// trieBuilder builds a trie bottom-up from nodes added in lexigraphical order.
+// It keeps the nodes along the right-most path of the trie on a stack. A node
+// is finished, and never touched again, when it is popped off because a node
+// that it doesn't contain was added. Each node is allocated once so building
+// takes time linear in the number of nodes and produces no garbage.
+type trieBuilder struct {
+	stack []*trieNode
+}
+
+// bit returns the bit in the prefix's address at the given position counting
+// from the most significant bit
+func bit(p Prefix, position uint32) int {
+	return int(p.addr.ui>>(31-position)) & 1
+}
+
+func (me *trieBuilder) push(node *trieNode) {
+	me.stack = append(me.stack, node)
+}
+
+func (me *trieBuilder) pop() *trieNode {
+	top := me.stack[len(me.stack)-1]
+	me.stack = me.stack[:len(me.stack)-1]
+	return top.mutate(func(*trieNode) {})
+}
+
+// add adds the given node which must come after every node added so far. The
+// node must be new and not already part of any trie.
+func (me *trieBuilder) add(node *trieNode) error {
+	// Pop until the top of the stack contains the new node
+	var completed *trieNode
+	for len(me.stack) > 0 {
+		top := me.stack[len(me.stack)-1]
+		result, _, _, _ := compare(top.Prefix, node.Prefix)
+		if result == compareSame {
+			return fmt.Errorf("duplicate prefix %s", node.Prefix)
+		}
+		if result == compareContains {
+			break
+		}
+		completed = me.pop()
+	}
+
+	var parent *trieNode
+	if len(me.stack) > 0 {
+		parent = me.stack[len(me.stack)-1]
+	}
+
+	attach := func(n *trieNode) {
+		if parent != nil {
+			parent.children[bit(n.Prefix, parent.Prefix.length)] = n
+		}
+		me.push(n)
+	}
+
+	if completed != nil {
+		_, _, common, _ := compare(completed.Prefix, node.Prefix)
+		if parent == nil || parent.Prefix.length < common {
+			// The completed subtrie and the new node belong on the same side
+			// of the parent. Join them with a new inactive node.
+			attach(&trieNode{
+				Prefix: Prefix{
+					addr: Address{
+						ui: node.Prefix.addr.ui & ^(uint32(0xffffffff) >> common), // zero out bits not in common
+					},
+					length: common,
+				},
+				children: [2]*trieNode{completed, nil},
+			})
+			parent = me.stack[len(me.stack)-1]
+		}
+	}
+	node.isActive = true
+	attach(node)
+	return nil
+}
+
+// finish finishes all of the remaining nodes and returns the root.
+func (me *trieBuilder) finish() (root *trieNode) {
+	for len(me.stack) > 0 {
+		root = me.pop()
+	}
+	return root
+}
+
+// TableXFromSorted builds a table from the given entries which must be sorted
+// in lexigraphical order (the same order Walk uses) with no duplicate prefixes.
+// Otherwise, an error is returned. It is much more efficient than inserting
+// each entry into a table one at a time; it takes time linear in the number of
+// entries and allocates only the table's nodes.
+//
+// The table uses a comparator for values that are comparable with ==.
+func TableXFromSorted(entries []TableXEntry) (TableX, error) {
+	builder := trieBuilder{}
+	for i, e := range entries {
+		if i > 0 && !entries[i-1].Prefix.lessThan(e.Prefix) {
+			if e.Prefix.lessThan(entries[i-1].Prefix) {
+				return TableX{}, fmt.Errorf("prefix %s is out of order after %s", e.Prefix, entries[i-1].Prefix)
+			}
+			return TableX{}, fmt.Errorf("duplicate prefix %s", e.Prefix)
+		}
+		if err := builder.add(&trieNode{Prefix: e.Prefix, Data: e.Value}); err != nil {
+			return TableX{}, err
+		}
+	}
+	return TableX{
+		builder.finish(),
+		defaultComparator,
+	}, nil
+}
+
+// setBuilder is like trieBuilder but builds a set, flattening each node as it
+// is finished. Nodes added must not overlap any added before.
+type setBuilder struct {
+	stack []*setNode
+}
+
+// pop finishes the node on top of the stack. The next node to be added, if
+// any, is needed to know whether the /24 that it is in is finished too.
+func (me *setBuilder) pop(next *setNode) *setNode {
+	top := me.stack[len(me.stack)-1]
+	me.stack = me.stack[:len(me.stack)-1]
+	top.flatten()
+	top.update()
+	if next == nil || next.Prefix.addr.ui>>8 != top.Prefix.addr.ui>>8 {
+		if leaf := top.compress(); leaf != top {
+			if len(me.stack) > 0 {
+				parent := me.stack[len(me.stack)-1]
+				parent.children[bit(top.Prefix, parent.Prefix.length)] = leaf
+			}
+			top = leaf
+		}
+	}
+	return top
+}
+
+func (me *setBuilder) add(node *setNode) {
+	// Pop until the top of the stack contains the new node
+	var completed *setNode
+	for len(me.stack) > 0 {
+		top := me.stack[len(me.stack)-1]
+		if result, _, _, _ := compare(top.Prefix, node.Prefix); result == compareContains {
+			break
+		}
+		completed = me.pop(node)
+	}
+
+	var parent *setNode
+	if len(me.stack) > 0 {
+		parent = me.stack[len(me.stack)-1]
+	}
+
+	attach := func(n *setNode) {
+		if parent != nil {
+			parent.children[bit(n.Prefix, parent.Prefix.length)] = n
+		}
+		me.stack = append(me.stack, n)
+	}
+
+	if completed != nil {
+		_, _, common, _ := compare(completed.Prefix, node.Prefix)
+		if parent == nil || parent.Prefix.length < common {
+			attach(&setNode{
+				Prefix: Prefix{
+					addr: Address{
+						ui: node.Prefix.addr.ui & ^(uint32(0xffffffff) >> common), // zero out bits not in common
+					},
+					length: common,
+				},
+				children: [2]*setNode{completed, nil},
+			})
+			parent = me.stack[len(me.stack)-1]
+		}
+	}
+	node.isActive = true
+	attach(node)
+}
+
+func (me *setBuilder) finish() (root *setNode) {
+	for len(me.stack) > 0 {
+		root = me.pop(nil)
+	}
+	return root
+}
+
+// SetFromPrefixes builds a set with all of the addresses in the given
+// prefixes. They may overlap and do not need to be sorted. If they are sorted
+// in lexigraphical order, it takes time linear in the number of prefixes and
+// allocates only the set's nodes. Otherwise, a sorted copy is made first.
+func SetFromPrefixes(prefixes []Prefix) Set {
+	if !sort.SliceIsSorted(prefixes, func(i, j int) bool {
+		return prefixes[i].Network().lessThan(prefixes[j].Network())
+	}) {
+		prefixes = append([]Prefix{}, prefixes...)
+		sort.Slice(prefixes, func(i, j int) bool {
+			return prefixes[i].Network().lessThan(prefixes[j].Network())
+		})
+	}
+
+	builder := setBuilder{}
+	var last *setNode
+	for _, p := range prefixes {
+		p = p.Network()
+		if last != nil {
+			if result, _, _, _ := compare(last.Prefix, p); result == compareSame || result == compareContains {
+				// Already covered by the last prefix
+				continue
+			}
+		}
+		last = &setNode{Prefix: p}
+		builder.add(last)
+	}
+	return Set{
+		trie: builder.finish(),
+	}
+}
@@ -0,0 +1,120 @@
+package ipv4
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func randomPrefixes(r *rand.Rand, n int) []Prefix {
+	prefixes := make([]Prefix, n)
+	for i := range prefixes {
+		prefixes[i] = Prefix{Address{r.Uint32()}, uint32(8 + r.Intn(25))}.Network()
+	}
+	return prefixes
+}
+
+func TestTableXFromSorted(t *testing.T) {
+	r := rand.New(rand.NewSource(34))
+
+	for _, n := range []int{0, 1, 2, 10, 1000} {
+		// Build the expected table the slow way
+		expected := NewTableX_()
+		for _, p := range randomPrefixes(r, n) {
+			expected.InsertOrUpdate(p, p.Length())
+		}
+
+		var entries []TableXEntry
+		expected.Table().Walk(func(p Prefix, value interface{}) bool {
+			entries = append(entries, TableXEntry{p, value})
+			return true
+		})
+
+		table, err := TableXFromSorted(entries)
+		require.Nil(t, err)
+		assert.True(t, table.trie.isValid())
+		assert.True(t, table.trie.Equal(expected.Table().trie, ieq))
+		assert.Equal(t, expected.NumEntries(), table.NumEntries())
+	}
+
+	t.Run("nested", func(t *testing.T) {
+		table, err := TableXFromSorted([]TableXEntry{
+			TableXEntry{_p("10.0.0.0/8"), 1},
+			TableXEntry{_p("10.0.0.0/16"), 2},
+			TableXEntry{_p("10.0.0.0/24"), 3},
+			TableXEntry{_p("10.0.1.0/24"), 4},
+			TableXEntry{_p("10.1.0.0/16"), 5},
+			TableXEntry{_p("11.0.0.0/8"), 6},
+		})
+		require.Nil(t, err)
+		assert.True(t, table.trie.isValid())
+		value, _, _ := table.LongestMatch(_a("10.0.1.1"))
+		assert.Equal(t, 4, value)
+		value, _, _ = table.LongestMatch(_a("10.0.2.1"))
+		assert.Equal(t, 2, value)
+		value, _, _ = table.LongestMatch(_a("10.2.0.1"))
+		assert.Equal(t, 1, value)
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		_, err := TableXFromSorted([]TableXEntry{
+			TableXEntry{_p("10.0.0.0/8"), 1},
+			TableXEntry{_p("10.0.0.0/8"), 2},
+		})
+		assert.NotNil(t, err)
+
+		// Same network with different host bits is still a duplicate
+		_, err = TableXFromSorted([]TableXEntry{
+			TableXEntry{_p("10.0.0.1/8"), 1},
+			TableXEntry{_p("10.0.0.2/8"), 2},
+		})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("unsorted", func(t *testing.T) {
+		_, err := TableXFromSorted([]TableXEntry{
+			TableXEntry{_p("10.0.0.0/16"), 1},
+			TableXEntry{_p("10.0.0.0/8"), 2},
+		})
+		assert.NotNil(t, err)
+	})
+}
+
+func TestSetFromPrefixes(t *testing.T) {
+	r := rand.New(rand.NewSource(34))
+
+	for _, n := range []int{0, 1, 2, 10, 1000} {
+		prefixes := randomPrefixes(r, n)
+
+		expected := NewSet_()
+		for _, p := range prefixes {
+			expected.Insert(p)
+		}
+
+		unsorted := SetFromPrefixes(prefixes)
+		assert.True(t, unsorted.isValid())
+		assert.True(t, unsorted.Equal(expected.Set()))
+
+		sort.Slice(prefixes, func(i, j int) bool {
+			return prefixes[i].lessThan(prefixes[j])
+		})
+		sorted := SetFromPrefixes(prefixes)
+		assert.True(t, sorted.isValid())
+		assert.True(t, sorted.Equal(expected.Set()))
+	}
+
+	t.Run("aggregates", func(t *testing.T) {
+		set := SetFromPrefixes([]Prefix{
+			_p("10.0.0.0/25"),
+			_p("10.0.0.128/26"),
+			_p("10.0.0.192/26"),
+			_p("10.0.1.0/24"),
+			_p("10.0.1.5/32"),
+		})
+		assert.True(t, set.isValid())
+		assert.Equal(t, "[10.0.0.0/23]", set.String())
+	})
+}
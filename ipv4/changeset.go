@@ -0,0 +1,148 @@
+package ipv4
+
+import (
+	"fmt"
+)
+
+// TableXEntry is a single prefix/value pair from a TableX
+type TableXEntry struct {
+	Prefix Prefix
+	Value  interface{}
+}
+
+// TableXModification describes a prefix whose value changed from Before to
+// After
+type TableXModification struct {
+	Prefix        Prefix
+	Before, After interface{}
+}
+
+// TableXChangeset is a first-class representation of the differences between
+// two TableX snapshots. Applying it to a table equal to the first snapshot
+// produces a table equal to the second.
+//
+// Each slice is sorted in lexigraphical order by prefix. All of the fields are
+// exported so that a changeset can be inspected directly or serialized with
+// encoding/json or a similar package. Prefix implements encoding.TextMarshaler
+// so it serializes in CIDR notation. How the values serialize is up to the
+// caller.
+//
+// The zero value of a TableXChangeset is empty and changes nothing.
+type TableXChangeset struct {
+	Added    []TableXEntry
+	Removed  []TableXEntry
+	Modified []TableXModification
+}
+
+// Changeset returns the changes needed to turn this table into the other. It is
+// built using Diff and so takes advantage of any structure that the two tables
+// share.
+func (me TableX) Changeset(other TableX) TableXChangeset {
+	var changeset TableXChangeset
+	me.Diff(other,
+		func(p Prefix, left, right interface{}) bool {
+			changeset.Modified = append(changeset.Modified, TableXModification{p, left, right})
+			return true
+		},
+		func(p Prefix, value interface{}) bool {
+			changeset.Removed = append(changeset.Removed, TableXEntry{p, value})
+			return true
+		},
+		func(p Prefix, value interface{}) bool {
+			changeset.Added = append(changeset.Added, TableXEntry{p, value})
+			return true
+		},
+		nil,
+	)
+	return changeset
+}
+
+// NumChanges returns the total number of added, removed, and modified entries
+func (me TableXChangeset) NumChanges() int {
+	return len(me.Added) + len(me.Removed) + len(me.Modified)
+}
+
+// Invert returns a changeset that undoes this one. Applying a changeset and
+// then its inverse results in the original table.
+func (me TableXChangeset) Invert() TableXChangeset {
+	// Copy the entries so that the two changesets don't share anything
+	copyEntries := func(entries []TableXEntry) []TableXEntry {
+		if entries == nil {
+			return nil
+		}
+		return append(make([]TableXEntry, 0, len(entries)), entries...)
+	}
+	inverse := TableXChangeset{
+		Added:   copyEntries(me.Removed),
+		Removed: copyEntries(me.Added),
+	}
+	if me.Modified != nil {
+		inverse.Modified = make([]TableXModification, len(me.Modified))
+		for i, m := range me.Modified {
+			inverse.Modified[i] = TableXModification{m.Prefix, m.After, m.Before}
+		}
+	}
+	return inverse
+}
+
+// apply returns the result of applying the changeset to the given trie. It
+// returns an error if the trie doesn't match the base that the changeset was
+// created from: an entry to remove or modify must exist with the value given
+// in the changeset and an entry to add must not already exist.
+func (me TableXChangeset) apply(trie *trieNode, eq comparator) (*trieNode, error) {
+	expect := func(p Prefix, value interface{}) error {
+		node := trie.Match(p)
+		if node == nil || node.Prefix.length != p.length {
+			return fmt.Errorf("changeset does not apply: %s does not exist", p)
+		}
+		if !eq(node.Data, value) {
+			return fmt.Errorf("changeset does not apply: %s has an unexpected value", p)
+		}
+		return nil
+	}
+
+	var err error
+	for _, e := range me.Removed {
+		if err = expect(e.Prefix, e.Value); err != nil {
+			return nil, err
+		}
+		if trie, err = trie.Delete(e.Prefix); err != nil {
+			return nil, err
+		}
+	}
+	for _, m := range me.Modified {
+		if err = expect(m.Prefix, m.Before); err != nil {
+			return nil, err
+		}
+		if trie, err = trie.Update(m.Prefix, m.After, eq); err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range me.Added {
+		if trie, err = trie.Insert(e.Prefix, e.Value); err != nil {
+			return nil, fmt.Errorf("changeset does not apply: %s: %w", e.Prefix, err)
+		}
+	}
+	return trie, nil
+}
+
+// Apply applies the given changeset to the table. The table must match the base
+// that the changeset was created from, at least where the changes are made.
+// Otherwise, an error is returned and the table is left unmodified.
+func (me TableX_) Apply(changeset TableXChangeset) error {
+	if me.m == nil {
+		panic("cannot modify an unitialized Table_")
+	}
+	var err error
+	if journalErr := me.mutate(func() (bool, *trieNode) {
+		var newHead *trieNode
+		newHead, err = changeset.apply(me.root(), me.m.eq)
+		if err != nil {
+			return false, nil
+		}
+		return true, newHead
+	}); journalErr != nil {
+		return journalErr
+	}
+	return err
+}
@@ -0,0 +1,125 @@
+package ipv4
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTableXChangeset(t *testing.T) {
+	a := TableX{}.Build(func(a_ TableX_) bool {
+		a_.Insert(_p("203.0.113.0/27"), 1)
+		a_.Insert(_p("203.0.113.64/27"), 2)
+		a_.Insert(_p("203.0.113.0/25"), 3)
+		return true
+	})
+
+	b := a.Build(func(b_ TableX_) bool {
+		b_.Remove(_p("203.0.113.64/27"))
+		b_.Insert(_p("203.0.113.96/27"), 4)
+		b_.Update(_p("203.0.113.0/25"), 5)
+		return true
+	})
+
+	changeset := a.Changeset(b)
+	assert.Equal(t, TableXChangeset{
+		Added: []TableXEntry{
+			TableXEntry{_p("203.0.113.96/27"), 4},
+		},
+		Removed: []TableXEntry{
+			TableXEntry{_p("203.0.113.64/27"), 2},
+		},
+		Modified: []TableXModification{
+			TableXModification{_p("203.0.113.0/25"), 3, 5},
+		},
+	}, changeset)
+	assert.Equal(t, 3, changeset.NumChanges())
+
+	assert.Equal(t, 0, a.Changeset(a).NumChanges())
+	assert.Equal(t, 0, TableXChangeset{}.Invert().NumChanges())
+
+	t.Run("apply", func(t *testing.T) {
+		a_ := a.Table_()
+		assert.Nil(t, a_.Apply(changeset))
+		assert.True(t, a_.Table().trie.Equal(b.trie, ieq))
+	})
+
+	t.Run("invert", func(t *testing.T) {
+		assert.Equal(t, b.Changeset(a), changeset.Invert())
+
+		b_ := b.Table_()
+		assert.Nil(t, b_.Apply(changeset.Invert()))
+		assert.True(t, b_.Table().trie.Equal(a.trie, ieq))
+
+		// Changing the inverse doesn't change the original
+		inverse := changeset.Invert()
+		inverse.Added[0].Value = 42
+		inverse.Removed[0].Value = 42
+		assert.Equal(t, 2, changeset.Removed[0].Value)
+		assert.NotEqual(t, 42, changeset.Added[0].Value)
+	})
+
+	t.Run("base_mismatch", func(t *testing.T) {
+		tests := []struct {
+			description string
+			base        TableX
+		}{
+			{
+				description: "target",
+				base:        b,
+			}, {
+				description: "removed_missing",
+				base: a.Build(func(t_ TableX_) bool {
+					t_.Remove(_p("203.0.113.64/27"))
+					return true
+				}),
+			}, {
+				description: "removed_different",
+				base: a.Build(func(t_ TableX_) bool {
+					t_.Update(_p("203.0.113.64/27"), 6)
+					return true
+				}),
+			}, {
+				description: "modified_different",
+				base: a.Build(func(t_ TableX_) bool {
+					t_.Update(_p("203.0.113.0/25"), 6)
+					return true
+				}),
+			}, {
+				description: "added_exists",
+				base: a.Build(func(t_ TableX_) bool {
+					t_.Insert(_p("203.0.113.96/27"), 4)
+					return true
+				}),
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.description, func(t *testing.T) {
+				t_ := tt.base.Table_()
+				assert.NotNil(t, t_.Apply(changeset))
+				assert.True(t, t_.Table().trie == tt.base.trie)
+			})
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		serialized, err := json.Marshal(changeset)
+		assert.Nil(t, err)
+
+		var deserialized TableXChangeset
+		assert.Nil(t, json.Unmarshal(serialized, &deserialized))
+		assert.Equal(t, _p("203.0.113.96/27"), deserialized.Added[0].Prefix)
+		assert.Equal(t, _p("203.0.113.64/27"), deserialized.Removed[0].Prefix)
+		assert.Equal(t, _p("203.0.113.0/25"), deserialized.Modified[0].Prefix)
+		assert.Equal(t, float64(5), deserialized.Modified[0].After)
+	})
+}
+
+func TestTableXApplyUninitialized(t *testing.T) {
+	var table TableX_
+	assert.Panics(t, func() {
+		table.Apply(TableXChangeset{})
+	})
+}
@@ -0,0 +1,125 @@
+package ipv4
+
+const (
+	// compiledPointer marks an element that refers to a chunk of the next level
+	// rather than to an entry
+	compiledPointer = uint32(1) << 31
+	compiledRootLen = 16
+	compiledStride  = 8
+)
+
+// CompiledTableX is a read-only snapshot of a TableX that is optimized for
+// looking up addresses. It is a multibit trie with strides of 16, 8, and 8
+// bits. The first level is a flat array indexed by the upper 16 bits of the
+// address so that a lookup takes at most three memory accesses to find the
+// match and never allocates.
+//
+// The cost is memory. The first level always takes 256KiB. Each prefix longer
+// than 16 bits requires a 1KiB chunk at the next level, for each /16 that
+// contains it, and one more for each /24 containing a prefix longer than 24
+// bits.
+type CompiledTableX struct {
+	// nodes holds the first level, indexed by the upper 16 bits of the address,
+	// followed by chunks of 256 elements for the other levels. Each element is
+	// either 0 for no match, the index+1 of the matched entry, or the offset of
+	// a chunk with compiledPointer set.
+	nodes   []uint32
+	entries []TableXEntry
+}
+
+// Compile returns a compiled lookup structure with exactly the same results
+// as LongestMatch on this table for any address. It takes time proportional
+// to the size of the structure that it builds. Since a TableX is immutable,
+// the result never needs to be updated; compile a new snapshot to see changes.
+func (me TableX) Compile() *CompiledTableX {
+	c := &CompiledTableX{
+		nodes:   make([]uint32, 1<<compiledRootLen),
+		entries: make([]TableXEntry, 0, me.NumEntries()),
+	}
+	// Walk visits shorter prefixes before the longer prefixes that they
+	// contain so each prefix can simply overwrite everything under it.
+	me.trie.Walk(func(prefix Prefix, value interface{}) bool {
+		c.entries = append(c.entries, TableXEntry{prefix, value})
+		c.insert(prefix, uint32(len(c.entries)))
+		return true
+	})
+	return c
+}
+
+// insert stores the entry in every element covered by the prefix, expanding
+// it to the next stride boundary
+func (me *CompiledTableX) insert(prefix Prefix, entry uint32) {
+	address := prefix.Network().addr.ui
+	slot := address >> (32 - compiledRootLen)
+	remaining := int(prefix.length) - compiledRootLen
+	if remaining <= 0 {
+		me.fill(slot, 1<<-remaining, entry)
+		return
+	}
+
+	shift := 32 - compiledRootLen - compiledStride
+	for {
+		slot = me.chunk(slot) + (address>>shift)&(1<<compiledStride-1)
+		if remaining <= compiledStride {
+			me.fill(slot, 1<<(compiledStride-remaining), entry)
+			return
+		}
+		remaining -= compiledStride
+		shift -= compiledStride
+	}
+}
+
+// chunk returns the offset of the chunk that the element at the given slot
+// points to, creating it if needed. A new chunk inherits the slot's match.
+func (me *CompiledTableX) chunk(slot uint32) uint32 {
+	element := me.nodes[slot]
+	if element&compiledPointer != 0 {
+		return element &^ compiledPointer
+	}
+	offset := uint32(len(me.nodes))
+	for i := 0; i < 1<<compiledStride; i++ {
+		me.nodes = append(me.nodes, element)
+	}
+	me.nodes[slot] = compiledPointer | offset
+	return offset
+}
+
+// fill stores the entry in count elements starting at the given slot and in
+// every element of the chunks that they point to
+func (me *CompiledTableX) fill(slot, count, entry uint32) {
+	for i := slot; i < slot+count; i++ {
+		if element := me.nodes[i]; element&compiledPointer != 0 {
+			me.fill(element&^compiledPointer, 1<<compiledStride, entry)
+			continue
+		}
+		me.nodes[i] = entry
+	}
+}
+
+// NumEntries returns the number of entries in the table that was compiled
+func (me *CompiledTableX) NumEntries() int64 {
+	return int64(len(me.entries))
+}
+
+// LookupAddress returns the value associated with the longest prefix in the
+// table that contains the given address, the same as LongestMatch. If a match
+// is found, it returns true and the Prefix matched. If no match is found,
+// returns nil, false, and matchPrefix must be ignored.
+func (me *CompiledTableX) LookupAddress(address Address) (value interface{}, found bool, matchPrefix Prefix) {
+	if len(me.nodes) == 0 {
+		return nil, false, Prefix{}
+	}
+	a := address.ui
+	element := me.nodes[a>>(32-compiledRootLen)]
+	if element&compiledPointer != 0 {
+		element = me.nodes[element&^compiledPointer+(a>>compiledStride)&(1<<compiledStride-1)]
+		if element&compiledPointer != 0 {
+			element = me.nodes[element&^compiledPointer+a&(1<<compiledStride-1)]
+		}
+	}
+	if element == 0 {
+		return nil, false, Prefix{}
+	}
+	entry := &me.entries[element-1]
+	return entry.Value, true, entry.Prefix
+}
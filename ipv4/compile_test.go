@@ -0,0 +1,115 @@
+package ipv4
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompiledTableX(t *testing.T) {
+	m := NewTableX_()
+	for i, p := range []string{
+		"0.0.0.0/0",
+		"10.0.0.0/8",
+		"10.0.0.0/16",
+		"10.0.0.0/17",
+		"10.0.1.0/24",
+		"10.0.1.128/25",
+		"10.0.1.200/32",
+		"10.224.0.0/11",
+		"192.168.0.0/23",
+		"192.168.1.7/32",
+		"255.255.255.255/32",
+	} {
+		m.Insert(_p(p), i)
+	}
+	table := m.Table()
+	compiled := table.Compile()
+	assert.Equal(t, table.NumEntries(), compiled.NumEntries())
+
+	for _, a := range []string{
+		"1.2.3.4",
+		"10.0.0.1",
+		"10.0.1.1",
+		"10.0.1.129",
+		"10.0.1.200",
+		"10.0.1.201",
+		"10.0.200.0",
+		"10.1.0.0",
+		"10.230.1.1",
+		"192.168.0.255",
+		"192.168.1.7",
+		"192.168.1.8",
+		"255.255.255.254",
+		"255.255.255.255",
+	} {
+		expected, _, expectedPrefix := table.LongestMatch(_a(a))
+		value, found, prefix := compiled.LookupAddress(_a(a))
+		assert.True(t, found)
+		assert.Equal(t, expected, value, a)
+		assert.Equal(t, expectedPrefix, prefix, a)
+	}
+
+	assert.Equal(t, 0.0, testing.AllocsPerRun(100, func() {
+		compiled.LookupAddress(_a("10.0.1.200"))
+	}))
+}
+
+func TestCompiledTableXEmpty(t *testing.T) {
+	_, found, _ := TableX{}.Compile().LookupAddress(_a("10.0.0.1"))
+	assert.False(t, found)
+	_, found, _ = (&CompiledTableX{}).LookupAddress(_a("10.0.0.1"))
+	assert.False(t, found)
+
+	m := NewTableX_()
+	m.Insert(_p("10.0.0.0/24"), 1)
+	compiled := m.Table().Compile()
+	_, found, _ = compiled.LookupAddress(_a("10.0.1.0"))
+	assert.False(t, found)
+	_, found, _ = compiled.LookupAddress(_a("9.255.255.255"))
+	assert.False(t, found)
+}
+
+func TestCompiledTableXRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+	m := NewTableX_()
+	for i := 0; i < 2000; i++ {
+		// Cluster the prefixes so that they nest and share chunks
+		address := Address{0x0a000000 | r.Uint32()&0x0003ffff}
+		m.Insert(Prefix{address, uint32(8 + r.Intn(25))}.Network(), i)
+	}
+	table := m.Table()
+	compiled := table.Compile()
+
+	for i := 0; i < 20000; i++ {
+		address := Address{0x0a000000 | r.Uint32()&0x0007ffff}
+		expected, expectedFound, expectedPrefix := table.LongestMatch(address)
+		value, found, prefix := compiled.LookupAddress(address)
+		assert.Equal(t, expectedFound, found)
+		assert.Equal(t, expected, value)
+		assert.Equal(t, expectedPrefix, prefix)
+	}
+}
+
+func BenchmarkCompiledLookup(b *testing.B) {
+	table, addresses := benchmarkTable(100000)
+	b.Run("LongestMatch", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, a := range addresses {
+				table.LongestMatch(a)
+			}
+		}
+	})
+	b.Run("LookupAddress", func(b *testing.B) {
+		compiled := table.Compile()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, a := range addresses {
+				compiled.LookupAddress(a)
+			}
+		}
+	})
+}
@@ -0,0 +1,188 @@
+package ipv4
+
+// TableXCursor is a position among the entries of a TableX which can be moved
+// forward or backward one entry at a time or positioned at an arbitrary key.
+// Each move takes time proportional to the height of the table's structure,
+// regardless of the position, so iteration can be resumed from any key without
+// visiting the entries before it. This is useful for paging through a large
+// table; remember the last prefix returned and later SeekAfter it.
+//
+// A cursor iterates the snapshot of the table it was created from and is not
+// affected by later changes to a TableX_. A cursor is not safe for concurrent
+// use but any number of cursors can be used on the same table.
+type TableXCursor struct {
+	table TableX
+	index int64
+}
+
+// Cursor returns a new cursor which isn't positioned at any entry yet so that
+// Next moves to the first entry and Prev moves to the last one.
+func (me TableX) Cursor() *TableXCursor {
+	return &TableXCursor{
+		table: me,
+		index: -1,
+	}
+}
+
+// Valid returns true if the cursor is positioned at an entry
+func (me *TableXCursor) Valid() bool {
+	return 0 <= me.index && me.index < me.table.NumEntries()
+}
+
+// Next moves the cursor to the next entry or, if it isn't positioned at an
+// entry, to the first one. If there isn't one, it returns false and the
+// cursor is no longer positioned at an entry.
+func (me *TableXCursor) Next() bool {
+	me.index = cursorNext(me.index, me.table.NumEntries())
+	return me.Valid()
+}
+
+// Prev moves the cursor to the previous entry or, if it isn't positioned at
+// an entry, to the last one. If there isn't one, it returns false and the
+// cursor is no longer positioned at an entry.
+func (me *TableXCursor) Prev() bool {
+	me.index = cursorPrev(me.index, me.table.NumEntries())
+	return me.Valid()
+}
+
+// Seek positions the cursor at the given prefix, if it exists in the table, or
+// else at the first entry that comes after it in the order that Walk visits
+// them. It returns false if there is no such entry.
+func (me *TableXCursor) Seek(prefix PrefixI) bool {
+	me.index = me.table.Rank(prefix)
+	if !me.Valid() {
+		me.index = -1
+	}
+	return me.Valid()
+}
+
+// SeekAfter positions the cursor at the first entry that comes after the given
+// prefix in the order that Walk visits them, whether or not the prefix exists
+// in the table. It returns false if there is no such entry.
+//
+// To resume paging, pass the last prefix returned. Unlike Seek followed by
+// Next, it doesn't skip an entry if that prefix has since been removed.
+func (me *TableXCursor) SeekAfter(prefix PrefixI) bool {
+	if prefix == nil {
+		prefix = Prefix{}
+	}
+	key := prefix.Prefix()
+	me.index = me.table.Rank(key)
+	if at, _, found := me.table.NthEntry(me.index); found && !key.lessThan(at) {
+		me.index++
+	}
+	if !me.Valid() {
+		me.index = -1
+	}
+	return me.Valid()
+}
+
+// Prefix returns the prefix at the cursor's position. It returns the zero
+// value if the cursor isn't positioned at an entry.
+func (me *TableXCursor) Prefix() Prefix {
+	prefix, _, _ := me.table.NthEntry(me.index)
+	return prefix
+}
+
+// Value returns the value at the cursor's position. It returns nil if the
+// cursor isn't positioned at an entry.
+func (me *TableXCursor) Value() interface{} {
+	_, value, _ := me.table.NthEntry(me.index)
+	return value
+}
+
+// SetCursor is a position among the prefixes of a Set, in the order that
+// WalkPrefixes visits them, which can be moved like a TableXCursor.
+type SetCursor struct {
+	set   Set
+	index int64
+}
+
+// Cursor returns a new cursor which isn't positioned at any prefix yet so that
+// Next moves to the first prefix and Prev moves to the last one.
+func (me Set) Cursor() *SetCursor {
+	return &SetCursor{
+		set:   me,
+		index: -1,
+	}
+}
+
+// Valid returns true if the cursor is positioned at a prefix
+func (me *SetCursor) Valid() bool {
+	return 0 <= me.index && me.index < me.set.trie.NumNodes()
+}
+
+// Next moves the cursor to the next prefix or, if it isn't positioned at a
+// prefix, to the first one. If there isn't one, it returns false.
+func (me *SetCursor) Next() bool {
+	me.index = cursorNext(me.index, me.set.trie.NumNodes())
+	return me.Valid()
+}
+
+// Prev moves the cursor to the previous prefix or, if it isn't positioned at
+// a prefix, to the last one. If there isn't one, it returns false.
+func (me *SetCursor) Prev() bool {
+	me.index = cursorPrev(me.index, me.set.trie.NumNodes())
+	return me.Valid()
+}
+
+// Seek positions the cursor at the prefix in the set which contains the given
+// one, if any, or else at the first prefix that comes after it. It returns
+// false if there is no such prefix.
+func (me *SetCursor) Seek(prefix PrefixI) bool {
+	if prefix == nil {
+		prefix = Prefix{}
+	}
+	key := prefix.Prefix()
+	me.index = me.set.trie.Rank(key)
+	if before, found := me.set.NthPrefix(me.index - 1); found && before.Contains(key) {
+		me.index--
+	}
+	if !me.Valid() {
+		me.index = -1
+	}
+	return me.Valid()
+}
+
+// SeekAfter positions the cursor at the first prefix that comes after the
+// given one in the order that WalkPrefixes visits them. Unlike Seek, it never
+// positions the cursor at a prefix containing the given one. It returns false
+// if there is no such prefix. See TableXCursor.SeekAfter.
+func (me *SetCursor) SeekAfter(prefix PrefixI) bool {
+	if prefix == nil {
+		prefix = Prefix{}
+	}
+	key := prefix.Prefix()
+	me.index = me.set.trie.Rank(key)
+	if at, found := me.set.NthPrefix(me.index); found && !key.lessThan(at) {
+		me.index++
+	}
+	if !me.Valid() {
+		me.index = -1
+	}
+	return me.Valid()
+}
+
+// Prefix returns the prefix at the cursor's position. It returns the zero
+// value if the cursor isn't positioned at a prefix.
+func (me *SetCursor) Prefix() Prefix {
+	prefix, _ := me.set.NthPrefix(me.index)
+	return prefix
+}
+
+// cursorNext returns the index after the given one among n items. -1 means not
+// positioned at any item; it comes after the last and before the first.
+func cursorNext(index, n int64) int64 {
+	if index+1 >= n {
+		return -1
+	}
+	return index + 1
+}
+
+// cursorPrev returns the index before the given one among n items
+func cursorPrev(index, n int64) int64 {
+	if index < 0 {
+		return n - 1
+	}
+	return index - 1
+}
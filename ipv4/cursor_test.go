@@ -0,0 +1,154 @@
+package ipv4
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTableXCursor(t *testing.T) {
+	m := NewTableX_()
+	prefixes := []Prefix{
+		_p("10.0.0.0/8"),
+		_p("10.0.0.0/16"),
+		_p("10.1.0.0/16"),
+		_p("172.16.0.0/12"),
+		_p("192.168.0.0/24"),
+	}
+	for i, p := range prefixes {
+		m.Insert(p, i)
+	}
+	c := m.Table().Cursor()
+	assert.False(t, c.Valid())
+	assert.Equal(t, Prefix{}, c.Prefix())
+	assert.Nil(t, c.Value())
+
+	for i, p := range prefixes {
+		assert.True(t, c.Next())
+		assert.Equal(t, p, c.Prefix())
+		assert.Equal(t, i, c.Value())
+	}
+	assert.False(t, c.Next())
+
+	for i := len(prefixes) - 1; i >= 0; i-- {
+		assert.True(t, c.Prev())
+		assert.Equal(t, prefixes[i], c.Prefix())
+	}
+	assert.False(t, c.Prev())
+	assert.True(t, c.Next())
+	assert.Equal(t, prefixes[0], c.Prefix())
+
+	// Once it runs off either end, the cursor starts over from the other
+	assert.False(t, c.Prev())
+	assert.True(t, c.Prev())
+	assert.Equal(t, prefixes[4], c.Prefix())
+
+	t.Run("seek", func(t *testing.T) {
+		c := m.Table().Cursor()
+		assert.True(t, c.Seek(_p("10.1.0.0/16")))
+		assert.Equal(t, _p("10.1.0.0/16"), c.Prefix())
+		assert.True(t, c.Next())
+		assert.Equal(t, _p("172.16.0.0/12"), c.Prefix())
+
+		assert.True(t, c.Seek(_p("10.0.1.0/24")))
+		assert.Equal(t, _p("10.1.0.0/16"), c.Prefix())
+		assert.True(t, c.Prev())
+		assert.Equal(t, _p("10.0.0.0/16"), c.Prefix())
+
+		assert.True(t, c.Seek(nil))
+		assert.Equal(t, _p("10.0.0.0/8"), c.Prefix())
+
+		assert.False(t, c.Seek(_p("192.168.1.0/24")))
+		assert.True(t, c.Prev())
+		assert.Equal(t, _p("192.168.0.0/24"), c.Prefix())
+	})
+
+	t.Run("seek after", func(t *testing.T) {
+		c := m.Table().Cursor()
+		assert.True(t, c.SeekAfter(_p("10.0.0.0/16")))
+		assert.Equal(t, _p("10.1.0.0/16"), c.Prefix())
+		assert.True(t, c.SeekAfter(_p("10.0.1.0/24")))
+		assert.Equal(t, _p("10.1.0.0/16"), c.Prefix())
+		assert.True(t, c.SeekAfter(nil))
+		assert.Equal(t, _p("10.0.0.0/8"), c.Prefix())
+		assert.False(t, c.SeekAfter(_p("192.168.0.0/24")))
+		assert.False(t, c.Valid())
+
+		// Paging resumes at the next entry even if the last one was removed
+		table := m.Table()
+		page := table.Cursor()
+		assert.True(t, page.Next())
+		assert.True(t, page.Next())
+		last := page.Prefix()
+		assert.Equal(t, _p("10.0.0.0/16"), last)
+		table = table.Build(func(t_ TableX_) bool {
+			t_.Remove(last)
+			return true
+		})
+		c = table.Cursor()
+		assert.True(t, c.SeekAfter(last))
+		assert.Equal(t, _p("10.1.0.0/16"), c.Prefix())
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		c := m.Table().Cursor()
+		m.Remove(_p("10.0.0.0/8"))
+		assert.True(t, c.Next())
+		assert.Equal(t, _p("10.0.0.0/8"), c.Prefix())
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		c := TableX{}.Cursor()
+		assert.False(t, c.Next())
+		assert.False(t, c.Prev())
+		assert.False(t, c.Seek(_p("10.0.0.0/8")))
+	})
+}
+
+func TestSetCursor(t *testing.T) {
+	set := _p("10.0.0.0/24").Set().
+		Union(_p("10.0.2.0/23")).
+		Union(_a("192.168.0.1"))
+
+	c := set.Cursor()
+	var prefixes []Prefix
+	for c.Next() {
+		prefixes = append(prefixes, c.Prefix())
+	}
+	assert.Equal(t, []Prefix{
+		_p("10.0.0.0/24"),
+		_p("10.0.2.0/23"),
+		_p("192.168.0.1/32"),
+	}, prefixes)
+	assert.True(t, c.Prev())
+	assert.Equal(t, _p("192.168.0.1/32"), c.Prefix())
+
+	// Seeking within a prefix positions at the prefix containing it
+	assert.True(t, c.Seek(_a("10.0.3.7")))
+	assert.Equal(t, _p("10.0.2.0/23"), c.Prefix())
+	assert.True(t, c.Seek(_p("10.0.2.0/23")))
+	assert.Equal(t, _p("10.0.2.0/23"), c.Prefix())
+	assert.True(t, c.Seek(_p("10.0.0.0/16")))
+	assert.Equal(t, _p("10.0.0.0/24"), c.Prefix())
+	assert.True(t, c.Seek(_a("10.0.1.0")))
+	assert.Equal(t, _p("10.0.2.0/23"), c.Prefix())
+	assert.False(t, c.Seek(_a("192.168.0.2")))
+	assert.Equal(t, Prefix{}, c.Prefix())
+	assert.True(t, c.Prev())
+	assert.Equal(t, _p("192.168.0.1/32"), c.Prefix())
+
+	// Seeking after a prefix never positions at one containing it
+	assert.True(t, c.SeekAfter(_a("10.0.3.7")))
+	assert.Equal(t, _p("192.168.0.1/32"), c.Prefix())
+	assert.True(t, c.SeekAfter(_p("10.0.0.0/24")))
+	assert.Equal(t, _p("10.0.2.0/23"), c.Prefix())
+	assert.True(t, c.SeekAfter(_p("10.0.1.0/24")))
+	assert.Equal(t, _p("10.0.2.0/23"), c.Prefix())
+	assert.False(t, c.SeekAfter(_a("192.168.0.1")))
+	assert.False(t, c.Valid())
+
+	c = Set{}.Cursor()
+	assert.False(t, c.Next())
+	assert.False(t, c.Seek(nil))
+	assert.False(t, c.SeekAfter(nil))
+}
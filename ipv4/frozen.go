@@ -0,0 +1,107 @@
+package ipv4
+
+import "sort"
+
+// FrozenSet is a read-only Set stored as a sorted array of the disjoint,
+// non-adjacent ranges that make it up. It is much smaller than a Set, a range
+// takes 8 bytes, and a lookup is a binary search over contiguous memory. It
+// is meant for large sets that are built once and queried many times.
+//
+// The zero value is an empty set.
+type FrozenSet struct {
+	ranges       []Range
+	numAddresses int64
+}
+
+var _ SetI = FrozenSet{}
+
+// Freeze returns a FrozenSet containing the same addresses as this set. It
+// takes time linear in the size of the set.
+func (me Set) Freeze() FrozenSet {
+	frozen := FrozenSet{
+		numAddresses: me.NumAddresses(),
+	}
+	me.WalkRanges(func(r Range) bool {
+		frozen.ranges = append(frozen.ranges, r)
+		return true
+	})
+	return frozen
+}
+
+// Set returns a Set containing the same addresses as this frozen set
+func (me FrozenSet) Set() Set {
+	builder := setBuilder{}
+	for _, r := range me.ranges {
+		r.walkPrefixes(func(p Prefix) bool {
+			builder.add(&setNode{Prefix: p})
+			return true
+		})
+	}
+	return Set{
+		trie: builder.finish(),
+	}
+}
+
+// NumAddresses returns the number of addresses in the set
+func (me FrozenSet) NumAddresses() int64 {
+	return me.numAddresses
+}
+
+// NumRanges returns the number of ranges that make up the set
+func (me FrozenSet) NumRanges() int {
+	return len(me.ranges)
+}
+
+// search returns the index of the first range which ends at or after the
+// given address or len(me.ranges) if there is none
+func (me FrozenSet) search(address Address) int {
+	return sort.Search(len(me.ranges), func(i int) bool {
+		return !me.ranges[i].last.lessThan(address)
+	})
+}
+
+// ContainsAddress returns true if the given address is in the set. Unlike
+// Contains, it never allocates.
+func (me FrozenSet) ContainsAddress(address Address) bool {
+	i := me.search(address)
+	return i < len(me.ranges) && !address.lessThan(me.ranges[i].first)
+}
+
+// Contains tests if all of the addresses in the given set are contained in
+// this one
+func (me FrozenSet) Contains(other SetI) bool {
+	if other == nil {
+		return true
+	}
+	return other.Set().WalkRanges(func(r Range) bool {
+		// The ranges are maximal so r must be inside of a single one
+		i := me.search(r.first)
+		return i < len(me.ranges) && !r.first.lessThan(me.ranges[i].first) && !me.ranges[i].last.lessThan(r.last)
+	})
+}
+
+// Overlaps tests if any address in the given set is also in this one
+func (me FrozenSet) Overlaps(other SetI) bool {
+	if other == nil {
+		return false
+	}
+	return !other.Set().WalkRanges(func(r Range) bool {
+		i := me.search(r.first)
+		// Stop walking at the first overlap
+		return i == len(me.ranges) || r.last.lessThan(me.ranges[i].first)
+	})
+}
+
+// WalkRanges calls `callback` for each range in the set in lexographical
+// order. It stops iteration immediately if callback returns false.
+//
+// It returns false if iteration was stopped due to a callback return false or
+// true if it iterated all items.
+func (me FrozenSet) WalkRanges(callback func(Range) bool) bool {
+	for _, r := range me.ranges {
+		if !callback(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,82 @@
+package ipv4
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrozenSet(t *testing.T) {
+	set := _p("10.0.0.0/24").Set().
+		Union(_r(_a("10.0.1.3"), _a("10.0.1.9"))).
+		Union(_p("10.0.1.10/31")).
+		Union(_a("192.168.0.1"))
+	frozen := set.Freeze()
+
+	assert.Equal(t, set.NumAddresses(), frozen.NumAddresses())
+	assert.Equal(t, 3, frozen.NumRanges())
+	assert.True(t, frozen.Set().Equal(set))
+	assert.True(t, frozen.Set().isValid())
+
+	var ranges []Range
+	frozen.WalkRanges(func(r Range) bool {
+		ranges = append(ranges, r)
+		return true
+	})
+	assert.Equal(t, []Range{
+		_r(_a("10.0.0.0"), _a("10.0.0.255")),
+		_r(_a("10.0.1.3"), _a("10.0.1.11")),
+		_r(_a("192.168.0.1"), _a("192.168.0.1")),
+	}, ranges)
+
+	for _, a := range []string{"9.255.255.255", "10.0.0.0", "10.0.1.2", "10.0.1.3", "10.0.1.11", "10.0.1.12", "192.168.0.1", "255.255.255.255"} {
+		assert.Equal(t, set.Contains(_a(a)), frozen.ContainsAddress(_a(a)), a)
+		assert.Equal(t, set.Contains(_a(a)), frozen.Contains(_a(a)), a)
+		assert.Equal(t, set.Contains(_a(a)), frozen.Overlaps(_a(a)), a)
+	}
+
+	assert.True(t, frozen.Contains(_p("10.0.0.128/25")))
+	assert.True(t, frozen.Contains(_r(_a("10.0.1.4"), _a("10.0.1.11"))))
+	assert.False(t, frozen.Contains(_r(_a("10.0.0.255"), _a("10.0.1.3"))))
+	assert.True(t, frozen.Contains(nil))
+	assert.True(t, frozen.Contains(set))
+
+	assert.True(t, frozen.Overlaps(_r(_a("10.0.0.255"), _a("10.0.1.3"))))
+	assert.True(t, frozen.Overlaps(_p("192.168.0.0/24")))
+	assert.False(t, frozen.Overlaps(_p("10.0.1.0/31")))
+	assert.False(t, frozen.Overlaps(_p("10.0.1.0/31").Set().Union(_p("11.0.0.0/8"))))
+	assert.False(t, frozen.Overlaps(nil))
+
+	assert.Equal(t, 0.0, testing.AllocsPerRun(10, func() {
+		frozen.ContainsAddress(_a("10.0.1.7"))
+	}))
+
+	t.Run("empty", func(t *testing.T) {
+		frozen := FrozenSet{}
+		assert.Equal(t, int64(0), frozen.NumAddresses())
+		assert.False(t, frozen.ContainsAddress(_a("10.0.0.0")))
+		assert.False(t, frozen.Overlaps(Prefix{}))
+		assert.True(t, frozen.Set().Equal(Set{}))
+		assert.True(t, Set{}.Freeze().Set().Equal(Set{}))
+	})
+
+	t.Run("everything", func(t *testing.T) {
+		frozen := Prefix{}.Set().Freeze()
+		assert.Equal(t, int64(1)<<32, frozen.NumAddresses())
+		assert.True(t, frozen.Contains(_a("255.255.255.255")))
+		assert.True(t, frozen.Set().Equal(Prefix{}.Set()))
+	})
+}
+
+func TestFrozenSetRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	set := SetFromPrefixes(randomPrefixes(r, 1000))
+	frozen := set.Freeze()
+	assert.True(t, frozen.Set().Equal(set))
+
+	for i := 0; i < 10000; i++ {
+		a := Address{r.Uint32()}
+		assert.Equal(t, set.Contains(a), frozen.ContainsAddress(a))
+	}
+}
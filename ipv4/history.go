@@ -0,0 +1,255 @@
+package ipv4
+
+import (
+	"fmt"
+	"sync"
+)
+
+// TableXHistory records a versioned history of snapshots of a TableX_. Every
+// modification made to the table, through any copy of it, is assigned the next
+// version number. The version current when recording started is 0.
+//
+// Only the most recent versions are retained, up to a limit given when
+// recording starts. Since snapshots share structure, retaining them is cheap;
+// the cost is proportional to the size of the changes between them.
+//
+// A version is assigned after each modification is made visible, not as part
+// of it. If multiple goroutines modify the table at the same time in
+// optimistic mode (see TableX_.Optimistic), one of them may make its change
+// visible before the version for another's is recorded. Then the two are
+// recorded as a single version and there is no snapshot of the contents in
+// between. Serialize writers if every modification needs its own version.
+type TableXHistory struct {
+	history
+	table     TableX_
+	snapshots []TableX
+}
+
+// history holds what is common to the histories of tables and sets
+type history struct {
+	lock   sync.Mutex
+	limit  uint64
+	latest uint64
+	closed bool
+}
+
+func (me *history) index(version uint64) int {
+	return int(version % me.limit)
+}
+
+func (me *history) oldest() uint64 {
+	if me.latest >= me.limit {
+		return me.latest - me.limit + 1
+	}
+	return 0
+}
+
+// available returns true if the given version is retained. Must be called
+// with the lock held.
+func (me *history) available(version uint64) bool {
+	return me.oldest() <= version && version <= me.latest
+}
+
+// History starts recording the history of this table, retaining up to limit
+// versions including the current one. A limit less than 1 is treated as 1. The
+// history should be closed when it is no longer needed.
+func (me TableX_) History(limit int) *TableXHistory {
+	if me.m == nil {
+		panic("cannot record the history of an unitialized Table_")
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	h := &TableXHistory{
+		history:   history{limit: uint64(limit)},
+		table:     me,
+		snapshots: make([]TableX, limit),
+	}
+	h.snapshots[0] = me.Table()
+	me.m.subscribers.add(h)
+	return h
+}
+
+func (me *TableXHistory) notify() {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if me.closed {
+		return
+	}
+
+	current := me.table.Table()
+	if current.trie == me.snapshots[me.index(me.latest)].trie {
+		return
+	}
+	me.latest++
+	me.snapshots[me.index(me.latest)] = current
+}
+
+// Close stops recording the history. The versions already retained remain
+// available.
+func (me *TableXHistory) Close() {
+	me.table.m.subscribers.remove(me)
+
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.closed = true
+}
+
+// Version returns the latest version
+func (me *TableXHistory) Version() uint64 {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	return me.latest
+}
+
+// Oldest returns the oldest version that is still retained
+func (me *TableXHistory) Oldest() uint64 {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	return me.oldest()
+}
+
+// Table returns the snapshot of the table at the given version. If the
+// version hasn't been reached yet or is no longer retained, found is false.
+func (me *TableXHistory) Table(version uint64) (table TableX, found bool) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if !me.available(version) {
+		return TableX{}, false
+	}
+	return me.snapshots[me.index(version)], true
+}
+
+// Changeset returns the changes between the two given versions. Either can be
+// older than the other. An error is returned if either is not retained.
+func (me *TableXHistory) Changeset(from, to uint64) (TableXChangeset, error) {
+	a, found := me.Table(from)
+	if !found {
+		return TableXChangeset{}, fmt.Errorf("version %d is not available", from)
+	}
+	b, found := me.Table(to)
+	if !found {
+		return TableXChangeset{}, fmt.Errorf("version %d is not available", to)
+	}
+	return a.Changeset(b), nil
+}
+
+// Rollback restores the table to its contents at the given version. The
+// rollback is itself a modification and so, if it changes anything, it
+// results in a new version; history is never rewritten. An error is returned
+// if the version is not retained.
+func (me *TableXHistory) Rollback(version uint64) error {
+	snapshot, found := me.Table(version)
+	if !found {
+		return fmt.Errorf("version %d is not available", version)
+	}
+	return me.table.mutate(func() (bool, *trieNode) {
+		return true, snapshot.trie
+	})
+}
+
+// SetHistory records a versioned history of snapshots of a Set_. It works
+// just like TableXHistory, including how concurrent modifications are
+// versioned.
+type SetHistory struct {
+	history
+	set       Set_
+	snapshots []Set
+}
+
+// History starts recording the history of this set, retaining up to limit
+// versions including the current one. A limit less than 1 is treated as 1. The
+// history should be closed when it is no longer needed.
+func (me Set_) History(limit int) *SetHistory {
+	if me.s == nil {
+		panic("cannot record the history of an unitialized Set_")
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	h := &SetHistory{
+		history:   history{limit: uint64(limit)},
+		set:       me,
+		snapshots: make([]Set, limit),
+	}
+	h.snapshots[0] = me.Set()
+	me.s.subscribers.add(h)
+	return h
+}
+
+func (me *SetHistory) notify() {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if me.closed {
+		return
+	}
+
+	current := me.set.Set()
+	if current.trie == me.snapshots[me.index(me.latest)].trie {
+		return
+	}
+	me.latest++
+	me.snapshots[me.index(me.latest)] = current
+}
+
+// Close stops recording the history. The versions already retained remain
+// available.
+func (me *SetHistory) Close() {
+	me.set.s.subscribers.remove(me)
+
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.closed = true
+}
+
+// Version returns the latest version
+func (me *SetHistory) Version() uint64 {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	return me.latest
+}
+
+// Oldest returns the oldest version that is still retained
+func (me *SetHistory) Oldest() uint64 {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	return me.oldest()
+}
+
+// Set returns the snapshot of the set at the given version. If the version
+// hasn't been reached yet or is no longer retained, found is false.
+func (me *SetHistory) Set(version uint64) (set Set, found bool) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if !me.available(version) {
+		return Set{}, false
+	}
+	return me.snapshots[me.index(version)], true
+}
+
+// Update returns the changes between the two given versions. Either can be
+// older than the other. An error is returned if either is not retained.
+func (me *SetHistory) Update(from, to uint64) (SetUpdate, error) {
+	a, found := me.Set(from)
+	if !found {
+		return SetUpdate{}, fmt.Errorf("version %d is not available", from)
+	}
+	b, found := me.Set(to)
+	if !found {
+		return SetUpdate{}, fmt.Errorf("version %d is not available", to)
+	}
+	return SetUpdate{a, b}, nil
+}
+
+// Rollback restores the set to its contents at the given version. Like
+// TableXHistory.Rollback, it results in a new version if it changes anything.
+// An error is returned if the version is not retained.
+func (me *SetHistory) Rollback(version uint64) error {
+	snapshot, found := me.Set(version)
+	if !found {
+		return fmt.Errorf("version %d is not available", version)
+	}
+	return me.set.mutate(func() (bool, *setNode) {
+		return true, snapshot.trie
+	})
+}
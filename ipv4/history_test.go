@@ -0,0 +1,146 @@
+package ipv4
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTableXHistory(t *testing.T) {
+	m := NewTableX_()
+	m.Insert(_p("10.0.0.0/24"), 1)
+
+	h := m.History(3)
+	defer h.Close()
+	assert.Equal(t, uint64(0), h.Version())
+
+	m.Insert(_p("10.0.1.0/24"), 2)
+	m.Insert(_p("10.0.1.0/24"), 2) // no-op, not a new version
+	assert.Equal(t, uint64(1), h.Version())
+
+	m.Update(_p("10.0.0.0/24"), 3)
+	assert.Equal(t, uint64(2), h.Version())
+	assert.Equal(t, uint64(0), h.Oldest())
+
+	v0, found := h.Table(0)
+	assert.True(t, found)
+	assert.Equal(t, int64(1), v0.NumEntries())
+
+	changeset, err := h.Changeset(0, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, TableXChangeset{
+		Added: []TableXEntry{
+			TableXEntry{_p("10.0.1.0/24"), 2},
+		},
+		Modified: []TableXModification{
+			TableXModification{_p("10.0.0.0/24"), 1, 3},
+		},
+	}, changeset)
+
+	_, found = h.Table(3)
+	assert.False(t, found)
+	_, err = h.Changeset(0, 3)
+	assert.NotNil(t, err)
+
+	t.Run("retention", func(t *testing.T) {
+		m.Remove(_p("10.0.1.0/24"))
+		assert.Equal(t, uint64(3), h.Version())
+		assert.Equal(t, uint64(1), h.Oldest())
+
+		_, found := h.Table(0)
+		assert.False(t, found)
+		_, err := h.Changeset(0, 3)
+		assert.NotNil(t, err)
+		assert.NotNil(t, h.Rollback(0))
+
+		v1, found := h.Table(1)
+		assert.True(t, found)
+		assert.Equal(t, int64(2), v1.NumEntries())
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		v1, _ := h.Table(1)
+		assert.Nil(t, h.Rollback(1))
+		assert.Equal(t, uint64(4), h.Version())
+		assert.True(t, m.Table().trie == v1.trie)
+
+		// The new version pushed out the one that was rolled back to
+		_, found := h.Table(1)
+		assert.False(t, found)
+
+		changeset, err := h.Changeset(3, 4)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, changeset.NumChanges())
+
+		// Rolling back to the current version changes nothing
+		assert.Nil(t, h.Rollback(4))
+		assert.Equal(t, uint64(4), h.Version())
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		h.Close()
+		m.Insert(_p("10.0.2.0/24"), 4)
+		assert.Equal(t, uint64(4), h.Version())
+		_, found := h.Table(4)
+		assert.True(t, found)
+	})
+}
+
+func TestTableXHistoryLimit(t *testing.T) {
+	m := NewTableX_()
+	h := m.History(0)
+	defer h.Close()
+
+	m.Insert(_p("10.0.0.0/24"), 1)
+	assert.Equal(t, uint64(1), h.Version())
+	assert.Equal(t, uint64(1), h.Oldest())
+	current, found := h.Table(1)
+	assert.True(t, found)
+	assert.True(t, current.trie == m.Table().trie)
+
+	assert.Panics(t, func() {
+		TableX_{}.History(1)
+	})
+}
+
+func TestSetHistory(t *testing.T) {
+	s := NewSet_()
+	s.Insert(_p("10.0.0.0/24"))
+
+	h := s.History(2)
+	defer h.Close()
+	assert.Equal(t, uint64(0), h.Version())
+
+	s.Insert(_p("10.0.1.0/24"))
+	s.Insert(_p("10.0.1.0/24")) // no-op, not a new version
+	assert.Equal(t, uint64(1), h.Version())
+	assert.Equal(t, uint64(0), h.Oldest())
+
+	update, err := h.Update(0, 1)
+	assert.Nil(t, err)
+	assert.True(t, update.Added().Equal(_p("10.0.1.0/24").Set()))
+	assert.Equal(t, int64(0), update.Removed().NumAddresses())
+
+	s.Remove(_p("10.0.0.0/25"))
+	assert.Equal(t, uint64(2), h.Version())
+	assert.Equal(t, uint64(1), h.Oldest())
+	_, found := h.Set(0)
+	assert.False(t, found)
+	_, err = h.Update(0, 2)
+	assert.NotNil(t, err)
+	assert.NotNil(t, h.Rollback(0))
+
+	v1, found := h.Set(1)
+	assert.True(t, found)
+	assert.Nil(t, h.Rollback(1))
+	assert.Equal(t, uint64(3), h.Version())
+	assert.True(t, s.Set().Equal(v1))
+
+	h.Close()
+	s.Insert(_p("10.0.2.0/24"))
+	assert.Equal(t, uint64(3), h.Version())
+
+	assert.Panics(t, func() {
+		Set_{}.History(1)
+	})
+}
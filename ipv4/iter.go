@@ -0,0 +1,76 @@
+//go:build go1.23
+
+package ipv4
+
+import "iter"
+
+// Addresses returns an iterator over the addresses in the prefix in
+// lexigraphical order. It ignores any bits set in the host part of the
+// address.
+func (me Prefix) Addresses() iter.Seq[Address] {
+	return me.Range().Addresses()
+}
+
+// Addresses returns an iterator over the addresses in the range in
+// lexigraphical order.
+func (me Range) Addresses() iter.Seq[Address] {
+	return func(yield func(Address) bool) {
+		me.walkAddresses(yield)
+	}
+}
+
+// Prefixes returns an iterator over the prefixes in the set in the same order
+// as WalkPrefixes.
+func (me Set) Prefixes() iter.Seq[Prefix] {
+	return func(yield func(Prefix) bool) {
+		me.WalkPrefixes(yield)
+	}
+}
+
+// PrefixesBackward returns an iterator over the prefixes in the set in the
+// same order as WalkPrefixesReverse.
+func (me Set) PrefixesBackward() iter.Seq[Prefix] {
+	return func(yield func(Prefix) bool) {
+		me.WalkPrefixesReverse(yield)
+	}
+}
+
+// Ranges returns an iterator over the ranges in the set in the same order as
+// WalkRanges.
+func (me Set) Ranges() iter.Seq[Range] {
+	return func(yield func(Range) bool) {
+		me.WalkRanges(yield)
+	}
+}
+
+// RangesBackward returns an iterator over the ranges in the set in the same
+// order as WalkRangesReverse.
+func (me Set) RangesBackward() iter.Seq[Range] {
+	return func(yield func(Range) bool) {
+		me.WalkRangesReverse(yield)
+	}
+}
+
+// Addresses returns an iterator over the addresses in the set in the same
+// order as WalkAddresses.
+func (me Set) Addresses() iter.Seq[Address] {
+	return func(yield func(Address) bool) {
+		me.WalkAddresses(yield)
+	}
+}
+
+// All returns an iterator over the prefix/value pairs in the table in the same
+// order as Walk.
+func (me TableX) All() iter.Seq2[Prefix, interface{}] {
+	return func(yield func(Prefix, interface{}) bool) {
+		me.Walk(yield)
+	}
+}
+
+// Backward returns an iterator over the prefix/value pairs in the table in the
+// same order as WalkReverse.
+func (me TableX) Backward() iter.Seq2[Prefix, interface{}] {
+	return func(yield func(Prefix, interface{}) bool) {
+		me.WalkReverse(yield)
+	}
+}
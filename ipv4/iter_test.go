@@ -0,0 +1,106 @@
+//go:build go1.23
+
+package ipv4
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixRangeAddresses(t *testing.T) {
+	var addresses []Address
+	for a := range _p("10.0.0.5/30").Addresses() {
+		addresses = append(addresses, a)
+	}
+	assert.Equal(t, []Address{_a("10.0.0.4"), _a("10.0.0.5"), _a("10.0.0.6"), _a("10.0.0.7")}, addresses)
+
+	// The end of the address space doesn't overflow
+	addresses = nil
+	for a := range _r(_a("255.255.255.254"), _a("255.255.255.255")).Addresses() {
+		addresses = append(addresses, a)
+	}
+	assert.Equal(t, []Address{_a("255.255.255.254"), _a("255.255.255.255")}, addresses)
+
+	var count int
+	for range (Prefix{}).Addresses() {
+		count++
+		if count == 3 {
+			break
+		}
+	}
+	assert.Equal(t, 3, count)
+}
+
+func TestSetIterators(t *testing.T) {
+	set := _p("10.0.0.0/31").Set().
+		Union(_p("10.0.0.2/32")).
+		Union(_a("192.168.0.1"))
+
+	var prefixes, walked []Prefix
+	for p := range set.Prefixes() {
+		prefixes = append(prefixes, p)
+	}
+	set.WalkPrefixes(func(p Prefix) bool {
+		walked = append(walked, p)
+		return true
+	})
+	assert.Equal(t, walked, prefixes)
+
+	prefixes = nil
+	for p := range set.PrefixesBackward() {
+		prefixes = append(prefixes, p)
+	}
+	assert.Equal(t, []Prefix{_p("192.168.0.1/32"), _p("10.0.0.2/32"), _p("10.0.0.0/31")}, prefixes)
+
+	var ranges []Range
+	for r := range set.Ranges() {
+		ranges = append(ranges, r)
+	}
+	assert.Equal(t, []Range{_r(_a("10.0.0.0"), _a("10.0.0.2")), _r(_a("192.168.0.1"), _a("192.168.0.1"))}, ranges)
+
+	ranges = nil
+	for r := range set.RangesBackward() {
+		ranges = append(ranges, r)
+		break
+	}
+	assert.Equal(t, []Range{_r(_a("192.168.0.1"), _a("192.168.0.1"))}, ranges)
+
+	var addresses []Address
+	for a := range set.Addresses() {
+		if a == _a("192.168.0.1") {
+			break
+		}
+		addresses = append(addresses, a)
+	}
+	assert.Equal(t, []Address{_a("10.0.0.0"), _a("10.0.0.1"), _a("10.0.0.2")}, addresses)
+
+	for range (Set{}).Prefixes() {
+		assert.Fail(t, "empty set yielded a prefix")
+	}
+}
+
+func TestTableXIterators(t *testing.T) {
+	m := NewTableX_()
+	m.Insert(_p("10.0.0.0/8"), 1)
+	m.Insert(_p("10.0.0.0/16"), 2)
+	m.Insert(_p("192.168.0.0/24"), 3)
+
+	var prefixes []Prefix
+	var values []interface{}
+	for p, v := range m.Table().All() {
+		prefixes = append(prefixes, p)
+		values = append(values, v)
+	}
+	assert.Equal(t, []Prefix{_p("10.0.0.0/8"), _p("10.0.0.0/16"), _p("192.168.0.0/24")}, prefixes)
+	assert.Equal(t, []interface{}{1, 2, 3}, values)
+
+	prefixes = nil
+	for p := range m.Table().Backward() {
+		prefixes = append(prefixes, p)
+		if len(prefixes) == 2 {
+			break
+		}
+	}
+	assert.Equal(t, []Prefix{_p("192.168.0.0/24"), _p("10.0.0.0/16")}, prefixes)
+}
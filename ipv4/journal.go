@@ -0,0 +1,598 @@
+package ipv4
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+// Journal format
+//
+// A journal is a sequence of records. Each record is framed by a 4 byte
+// length and a 4 byte CRC-32 (IEEE) of the payload, both big-endian, followed
+// by the payload itself. The first byte of the payload is the record type.
+//
+// A snapshot record replaces the entire contents with the entries that follow.
+// A changes record holds all of the changes made by a single modification.
+// Either is followed by a uvarint count of operations and then each operation:
+// a 1 byte kind, the 4 byte address and 1 byte length of the prefix and, only
+// for a put into a table, a uvarint length and the encoded value.
+
+const (
+	recordSnapshot byte = iota + 1
+	recordChanges
+)
+
+const (
+	opPut byte = iota + 1
+	opRemove
+)
+
+// maxRecordLength is the longest record that will be read from a journal. It
+// protects against allocating a huge buffer because of a corrupt length.
+const maxRecordLength = 1 << 30
+
+// errTornRecord indicates that the final record in a journal is incomplete,
+// likely because a crash interrupted writing it.
+var errTornRecord = errors.New("torn record")
+
+// JournalOptions configures a TableXJournal or SetJournal. The zero value
+// never compacts automatically.
+type JournalOptions struct {
+	// CompactAfter, if positive, compacts the journal automatically after
+	// this many change records have been written since the last snapshot.
+	// Rotate must be set too.
+	CompactAfter int
+
+	// Rotate returns the writer for a new journal when compacting
+	// automatically. The journal switches to it after writing a snapshot of
+	// the current contents. The caller is responsible for discarding the old
+	// one after that.
+	Rotate func() (io.Writer, error)
+}
+
+// journal holds what is common to journaling tables and sets
+type journal struct {
+	lock    sync.Mutex
+	w       io.Writer
+	opts    JournalOptions
+	records int
+	err     error
+}
+
+// syncer is implemented by writers, like *os.File, that can flush to stable
+// storage.
+type syncer interface {
+	Sync() error
+}
+
+func writeRecord(w io.Writer, payload []byte) error {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+	if _, err := w.Write(append(header[:], payload...)); err != nil {
+		return err
+	}
+	if s, ok := w.(syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// readRecord returns the next payload, io.EOF if there are no more records, or
+// errTornRecord if the final record is incomplete or corrupt.
+func readRecord(r *bufio.Reader) ([]byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errTornRecord
+		}
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxRecordLength {
+		return nil, fmt.Errorf("journal is corrupt: record too long")
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return nil, errTornRecord
+		}
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		if _, err := r.Peek(1); err == io.EOF {
+			return nil, errTornRecord
+		}
+		return nil, fmt.Errorf("journal is corrupt: checksum mismatch")
+	}
+	return payload, nil
+}
+
+// replay calls handle for each record in the journal, ignoring a torn final
+// record.
+func replay(r io.Reader, handle func(kind byte, ops *opReader) error) error {
+	br := bufio.NewReader(r)
+	for {
+		payload, err := readRecord(br)
+		switch err {
+		case nil:
+		case io.EOF, errTornRecord:
+			return nil
+		default:
+			return err
+		}
+		if len(payload) == 0 {
+			return fmt.Errorf("journal is corrupt: empty record")
+		}
+		ops := &opReader{buf: payload[1:]}
+		if err := handle(payload[0], ops); err != nil {
+			return err
+		}
+	}
+}
+
+func appendUint32(buf []byte, ui uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], ui)
+	return append(buf, b[:]...)
+}
+
+func appendUvarint(buf []byte, ui uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], ui)]...)
+}
+
+func appendOp(buf []byte, kind byte, p Prefix) []byte {
+	buf = append(buf, kind)
+	buf = appendUint32(buf, p.addr.ui)
+	return append(buf, byte(p.length))
+}
+
+// opReader decodes the operations in a record payload
+type opReader struct {
+	buf []byte
+}
+
+var errCorruptOp = errors.New("journal is corrupt: truncated operation")
+
+func (me *opReader) count() (int, error) {
+	n, size := binary.Uvarint(me.buf)
+	if size <= 0 {
+		return 0, errCorruptOp
+	}
+	me.buf = me.buf[size:]
+	return int(n), nil
+}
+
+func (me *opReader) op() (kind byte, p Prefix, err error) {
+	if len(me.buf) < 6 {
+		return 0, Prefix{}, errCorruptOp
+	}
+	kind = me.buf[0]
+	p = Prefix{Address{binary.BigEndian.Uint32(me.buf[1:5])}, uint32(me.buf[5])}
+	me.buf = me.buf[6:]
+	if p.length > 32 {
+		return 0, Prefix{}, fmt.Errorf("journal is corrupt: invalid prefix length")
+	}
+	return kind, p, nil
+}
+
+func (me *opReader) value() ([]byte, error) {
+	n, size := binary.Uvarint(me.buf)
+	if size <= 0 || uint64(len(me.buf)-size) < n {
+		return nil, errCorruptOp
+	}
+	value := me.buf[size : size+int(n)]
+	me.buf = me.buf[size+int(n):]
+	return value, nil
+}
+
+// write writes a record with the given payload unless a previous write failed.
+// Must be called with the lock held.
+func (me *journal) write(payload []byte) error {
+	if me.err != nil {
+		return me.err
+	}
+	if me.err = writeRecord(me.w, payload); me.err != nil {
+		return me.err
+	}
+	me.records++
+	return nil
+}
+
+// maybeCompact compacts using the given snapshot function if it is time. Must
+// be called with the lock held.
+func (me *journal) maybeCompact(snapshot func() ([]byte, error)) {
+	if me.opts.CompactAfter <= 0 || me.records < me.opts.CompactAfter || me.opts.Rotate == nil {
+		return
+	}
+	var w io.Writer
+	if w, me.err = me.opts.Rotate(); me.err != nil {
+		return
+	}
+	me.err = me.compact(w, snapshot)
+}
+
+// compact writes a snapshot to the given writer and switches to it. Must be
+// called with the lock held.
+func (me *journal) compact(w io.Writer, snapshot func() ([]byte, error)) error {
+	payload, err := snapshot()
+	if err != nil {
+		return err
+	}
+	if err := writeRecord(w, payload); err != nil {
+		return err
+	}
+	me.w = w
+	me.records = 0
+	return nil
+}
+
+// TableXJournal durably records every modification made to a TableX_, through
+// any copy of it, so that the table can be rebuilt after a restart with
+// TableX_.Recover. Each modification is written as a single record before it
+// is made visible so batches made with Transact or Apply are recorded
+// atomically.
+//
+// If a record can't be encoded or written, the modification is not made. The
+// methods that report success, like Insert or Apply, report the failure.
+// InsertOrUpdate and RemoveSet leave the table unmodified without saying so
+// and GetOrInsert returns nil, so check Err after using them. Once an error
+// occurs, it is returned by Err and every later modification fails until the
+// journal is closed.
+//
+// Modifications to a journaled table are committed one at a time, even in
+// optimistic mode. Values are stored using an encode function given when
+// journaling starts.
+type TableXJournal struct {
+	journal
+	table  TableX_
+	encode func(interface{}) ([]byte, error)
+}
+
+// Journal starts journaling modifications to this table to the given writer.
+// It first writes a snapshot of the current contents. The journal should be
+// closed when it is no longer needed. A table can only have one journal at a
+// time.
+func (me TableX_) Journal(w io.Writer, encode func(interface{}) ([]byte, error), opts JournalOptions) (*TableXJournal, error) {
+	if me.m == nil {
+		panic("cannot journal an unitialized Table_")
+	}
+	j := &TableXJournal{
+		journal: journal{w: w, opts: opts},
+		table:   me,
+		encode:  encode,
+	}
+	me.m.lock.Lock()
+	defer me.m.lock.Unlock()
+	if me.m.journal != nil {
+		return nil, fmt.Errorf("table is already being journaled")
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	current := me.Table()
+	if err := j.compact(w, func() ([]byte, error) { return j.snapshot(current) }); err != nil {
+		return nil, err
+	}
+	me.m.journal = j
+	return j, nil
+}
+
+func (me *TableXJournal) appendPut(buf []byte, p Prefix, value interface{}) ([]byte, error) {
+	encoded, err := me.encode(value)
+	if err != nil {
+		return nil, err
+	}
+	buf = appendOp(buf, opPut, p)
+	buf = appendUvarint(buf, uint64(len(encoded)))
+	return append(buf, encoded...), nil
+}
+
+// snapshot returns the payload for a snapshot of the given contents
+func (me *TableXJournal) snapshot(table TableX) ([]byte, error) {
+	buf := []byte{recordSnapshot}
+	buf = appendUvarint(buf, uint64(table.NumEntries()))
+	var err error
+	table.Walk(func(p Prefix, value interface{}) bool {
+		buf, err = me.appendPut(buf, p, value)
+		return err == nil
+	})
+	return buf, err
+}
+
+// commit writes a record of the changes from oldNode to newNode and then
+// swaps them if the table's root is still oldNode. It is called by the table
+// with its lock held for reading instead of swapping directly.
+func (me *TableXJournal) commit(oldNode, newNode *trieNode) (bool, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if me.err != nil {
+		return false, me.err
+	}
+	if me.table.root() != oldNode {
+		return false, nil
+	}
+
+	eq := me.table.m.eq
+	changeset := TableX{oldNode, eq}.Changeset(TableX{newNode, eq})
+	buf := []byte{recordChanges}
+	buf = appendUvarint(buf, uint64(changeset.NumChanges()))
+	for _, e := range changeset.Removed {
+		buf = appendOp(buf, opRemove, e.Prefix)
+	}
+	for _, m := range changeset.Modified {
+		if buf, me.err = me.appendPut(buf, m.Prefix, m.After); me.err != nil {
+			return false, me.err
+		}
+	}
+	for _, e := range changeset.Added {
+		if buf, me.err = me.appendPut(buf, e.Prefix, e.Value); me.err != nil {
+			return false, me.err
+		}
+	}
+	if err := me.write(buf); err != nil {
+		return false, err
+	}
+
+	// Every swap goes through here while journaling so this can't fail
+	swapTrieNodePtr(&me.table.m.trie, oldNode, newNode)
+	me.maybeCompact(func() ([]byte, error) {
+		return me.snapshot(TableX{newNode, eq})
+	})
+	return true, nil
+}
+
+// Compact writes a snapshot of the current contents to the given writer and
+// continues journaling there. After it returns, the old journal is no longer
+// needed.
+func (me *TableXJournal) Compact(w io.Writer) error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if me.err != nil {
+		return me.err
+	}
+	// Holding the lock keeps the contents from changing
+	current := me.table.Table()
+	return me.compact(w, func() ([]byte, error) { return me.snapshot(current) })
+}
+
+// Err returns the first error encountered writing the journal. Once an error
+// occurs, nothing more is written and modifications to the table fail.
+func (me *TableXJournal) Err() error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	return me.err
+}
+
+// Close stops journaling and returns the first error encountered, if any.
+// Afterward, the table can be modified again even if journaling failed.
+func (me *TableXJournal) Close() error {
+	me.table.m.lock.Lock()
+	if me.table.m.journal == me {
+		me.table.m.journal = nil
+	}
+	me.table.m.lock.Unlock()
+
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	return me.err
+}
+
+// Recover replaces the contents of the table with the contents recorded in
+// the given journal, decoding values with the given function. A torn final
+// record, left by a crash in the middle of writing it, is ignored. The table
+// is replaced atomically and only if the entire journal can be read (and, if
+// the table itself is being journaled, the replacement can be recorded).
+func (me TableX_) Recover(r io.Reader, decode func([]byte) (interface{}, error)) error {
+	if me.m == nil {
+		panic("cannot modify an unitialized Table_")
+	}
+
+	var trie *trieNode
+	err := replay(r, func(kind byte, ops *opReader) error {
+		if kind == recordSnapshot {
+			trie = nil
+		} else if kind != recordChanges {
+			return fmt.Errorf("journal is corrupt: unknown record type %d", kind)
+		}
+		n, err := ops.count()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			op, p, err := ops.op()
+			if err != nil {
+				return err
+			}
+			switch op {
+			case opPut:
+				encoded, err := ops.value()
+				if err != nil {
+					return err
+				}
+				value, err := decode(encoded)
+				if err != nil {
+					return err
+				}
+				trie = trie.InsertOrUpdate(p, value, me.m.eq)
+			case opRemove:
+				if trie, err = trie.Delete(p); err != nil {
+					return fmt.Errorf("journal is corrupt: %w", err)
+				}
+			default:
+				return fmt.Errorf("journal is corrupt: unknown operation %d", op)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return me.mutate(func() (bool, *trieNode) {
+		return true, trie
+	})
+}
+
+// SetJournal durably records every modification made to a Set_ so that it can
+// be rebuilt after a restart with Set_.Recover. If a record can't be written,
+// the modification is not made. Set_.Insert and Set_.Remove don't report it so
+// check Err after using them. See TableXJournal.
+type SetJournal struct {
+	journal
+	set Set_
+}
+
+// Journal starts journaling modifications to this set to the given writer. It
+// first writes a snapshot of the current contents. The journal should be
+// closed when it is no longer needed. A set can only have one journal at a
+// time.
+func (me Set_) Journal(w io.Writer, opts JournalOptions) (*SetJournal, error) {
+	if me.s == nil {
+		panic("cannot journal an unitialized Set_")
+	}
+	j := &SetJournal{
+		journal: journal{w: w, opts: opts},
+		set:     me,
+	}
+	me.s.lock.Lock()
+	defer me.s.lock.Unlock()
+	if me.s.journal != nil {
+		return nil, fmt.Errorf("set is already being journaled")
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	current := me.Set()
+	if err := j.compact(w, func() ([]byte, error) { return j.snapshot(current) }); err != nil {
+		return nil, err
+	}
+	me.s.journal = j
+	return j, nil
+}
+
+func appendPrefixes(buf []byte, kind byte, set Set) []byte {
+	set.WalkPrefixes(func(p Prefix) bool {
+		buf = appendOp(buf, kind, p)
+		return true
+	})
+	return buf
+}
+
+func (me *SetJournal) snapshot(set Set) ([]byte, error) {
+	buf := []byte{recordSnapshot}
+	buf = appendUvarint(buf, uint64(set.trie.NumNodes()))
+	return appendPrefixes(buf, opPut, set), nil
+}
+
+// commit writes a record of the changes from oldNode to newNode and then
+// swaps them. See TableXJournal.commit.
+func (me *SetJournal) commit(oldNode, newNode *setNode) (bool, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if me.err != nil {
+		return false, me.err
+	}
+	if me.set.root() != oldNode {
+		return false, nil
+	}
+
+	update := SetUpdate{Set{oldNode}, Set{newNode}}
+	removed, added := update.Removed(), update.Added()
+
+	buf := []byte{recordChanges}
+	buf = appendUvarint(buf, uint64(removed.trie.NumNodes()+added.trie.NumNodes()))
+	buf = appendPrefixes(buf, opRemove, removed)
+	buf = appendPrefixes(buf, opPut, added)
+	if err := me.write(buf); err != nil {
+		return false, err
+	}
+
+	swapSetNodePtr(&me.set.s.trie, oldNode, newNode)
+	me.maybeCompact(func() ([]byte, error) {
+		return me.snapshot(Set{newNode})
+	})
+	return true, nil
+}
+
+// Compact writes a snapshot of the current contents to the given writer and
+// continues journaling there. After it returns, the old journal is no longer
+// needed.
+func (me *SetJournal) Compact(w io.Writer) error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if me.err != nil {
+		return me.err
+	}
+	current := me.set.Set()
+	return me.compact(w, func() ([]byte, error) { return me.snapshot(current) })
+}
+
+// Err returns the first error encountered writing the journal. Once an error
+// occurs, nothing more is written and modifications to the set fail.
+func (me *SetJournal) Err() error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	return me.err
+}
+
+// Close stops journaling and returns the first error encountered, if any.
+func (me *SetJournal) Close() error {
+	me.set.s.lock.Lock()
+	if me.set.s.journal == me {
+		me.set.s.journal = nil
+	}
+	me.set.s.lock.Unlock()
+
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	return me.err
+}
+
+// Recover replaces the contents of the set with the contents recorded in the
+// given journal. A torn final record is ignored. The set is replaced
+// atomically and only if the entire journal can be read.
+func (me Set_) Recover(r io.Reader) error {
+	if me.s == nil {
+		panic("cannot modify an unitialized Set_")
+	}
+
+	var trie *setNode
+	err := replay(r, func(kind byte, ops *opReader) error {
+		if kind == recordSnapshot {
+			trie = nil
+		} else if kind != recordChanges {
+			return fmt.Errorf("journal is corrupt: unknown record type %d", kind)
+		}
+		n, err := ops.count()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			op, p, err := ops.op()
+			if err != nil {
+				return err
+			}
+			switch op {
+			case opPut:
+				trie = trie.Union(setNodeFromPrefix(p))
+			case opRemove:
+				trie = trie.Difference(setNodeFromPrefix(p))
+			default:
+				return fmt.Errorf("journal is corrupt: unknown operation %d", op)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return me.mutate(func() (bool, *setNode) {
+		return true, trie
+	})
+}
@@ -0,0 +1,259 @@
+package ipv4
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encodeJSON(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func decodeJSON(encoded []byte) (interface{}, error) {
+	var value interface{}
+	err := json.Unmarshal(encoded, &value)
+	return value, err
+}
+
+func TestTableXJournal(t *testing.T) {
+	m := NewTableX_()
+	m.Insert(_p("10.0.0.0/8"), "a")
+
+	var buf bytes.Buffer
+	j, err := m.Journal(&buf, encodeJSON, JournalOptions{})
+	require.Nil(t, err)
+
+	m.Insert(_p("10.1.0.0/16"), "b")
+	m.Insert(_p("10.2.0.0/16"), "c")
+	m.Update(_p("10.0.0.0/8"), "d")
+	m.Remove(_p("10.1.0.0/16"))
+	m.Transact(func(t_ TableX_) bool {
+		t_.Insert(_p("192.168.0.0/16"), "e")
+		t_.Insert(_p("192.168.1.0/24"), "f")
+		return true
+	})
+	m.RemoveSet(_p("10.2.128.0/17"))
+	assert.Nil(t, j.Close())
+
+	// Not journaled after closing
+	m.Insert(_p("172.16.0.0/12"), "g")
+
+	recovered := NewTableX_()
+	recovered.Insert(_p("203.0.113.0/24"), "replaced")
+	require.Nil(t, recovered.Recover(bytes.NewReader(buf.Bytes()), decodeJSON))
+
+	expected := m.Table().Build(func(t_ TableX_) bool {
+		t_.Remove(_p("172.16.0.0/12"))
+		return true
+	})
+	assert.True(t, recovered.Table().trie.Equal(expected.trie, ieq))
+
+	t.Run("torn", func(t *testing.T) {
+		// Every truncation recovers some consistent prefix of the history
+		for i := 1; i < buf.Len(); i++ {
+			torn := NewTableX_()
+			require.Nil(t, torn.Recover(bytes.NewReader(buf.Bytes()[:i]), decodeJSON), i)
+			assert.True(t, torn.Table().trie.isValid())
+		}
+
+		// A corrupt final record is ignored
+		corrupt := append([]byte{}, buf.Bytes()...)
+		corrupt[len(corrupt)-1] ^= 0xff
+		torn := NewTableX_()
+		require.Nil(t, torn.Recover(bytes.NewReader(corrupt), decodeJSON))
+		assert.Equal(t, int64(4), torn.NumEntries())
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		// A corrupt record followed by others is an error
+		corrupt := append([]byte{}, buf.Bytes()...)
+		corrupt[10] ^= 0xff
+		table := NewTableX_()
+		table.Insert(_p("203.0.113.0/24"), "untouched")
+		assert.NotNil(t, table.Recover(bytes.NewReader(corrupt), decodeJSON))
+		assert.Equal(t, int64(1), table.NumEntries())
+	})
+}
+
+func TestTableXJournalCompact(t *testing.T) {
+	m := NewTableX_()
+
+	var journals []*bytes.Buffer
+	rotate := func() (io.Writer, error) {
+		journals = append(journals, &bytes.Buffer{})
+		return journals[len(journals)-1], nil
+	}
+	w, _ := rotate()
+	j, err := m.Journal(w, encodeJSON, JournalOptions{CompactAfter: 3, Rotate: rotate})
+	require.Nil(t, err)
+	defer j.Close()
+
+	for i := 0; i < 8; i++ {
+		m.Insert(Prefix{AddressFromBytes(10, byte(i), 0, 0), 16}, float64(i))
+	}
+	assert.Equal(t, 3, len(journals))
+
+	recovered := NewTableX_()
+	require.Nil(t, recovered.Recover(journals[2], decodeJSON))
+	assert.True(t, recovered.Table().trie.Equal(m.Table().trie, ieq))
+
+	var compacted bytes.Buffer
+	require.Nil(t, j.Compact(&compacted))
+	m.Remove(_p("10.0.0.0/16"))
+	recovered = NewTableX_()
+	require.Nil(t, recovered.Recover(&compacted, decodeJSON))
+	assert.Equal(t, int64(7), recovered.NumEntries())
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestTableXJournalErrors(t *testing.T) {
+	m := NewTableX_()
+	_, err := m.Journal(failingWriter{}, encodeJSON, JournalOptions{})
+	assert.NotNil(t, err)
+
+	var buf bytes.Buffer
+	j, err := m.Journal(&buf, func(interface{}) ([]byte, error) {
+		return nil, errors.New("can't encode")
+	}, JournalOptions{})
+	require.Nil(t, err)
+	_, err = m.Journal(&buf, encodeJSON, JournalOptions{})
+	assert.NotNil(t, err)
+
+	// Nothing is modified if it can't be journaled
+	assert.False(t, m.Insert(_p("10.0.0.0/8"), 1))
+	assert.NotNil(t, j.Err())
+	m.InsertOrUpdate(_p("10.0.0.0/8"), 1)
+	assert.Equal(t, int64(0), m.NumEntries())
+	assert.NotNil(t, j.Close())
+
+	// Modifications work again after closing
+	assert.True(t, m.Insert(_p("10.0.0.0/8"), 1))
+
+	assert.Panics(t, func() {
+		TableX_{}.Journal(&buf, encodeJSON, JournalOptions{})
+	})
+}
+
+// limitedWriter fails once it has written n records
+type limitedWriter struct {
+	bytes.Buffer
+	n int
+}
+
+func (me *limitedWriter) Write(b []byte) (int, error) {
+	if me.n == 0 {
+		return 0, errors.New("disk full")
+	}
+	me.n--
+	return me.Buffer.Write(b)
+}
+
+func TestTableXJournalWriteAhead(t *testing.T) {
+	m := NewTableX_()
+	history := m.History(10)
+	defer history.Close()
+
+	w := &limitedWriter{n: 2}
+	j, err := m.Journal(w, encodeJSON, JournalOptions{})
+	require.Nil(t, err)
+	assert.True(t, m.Insert(_p("10.0.0.0/8"), "a"))
+
+	// The failed write leaves the table, and its history, untouched
+	assert.False(t, m.Insert(_p("10.1.0.0/16"), "b"))
+	assert.False(t, m.Transact(func(t_ TableX_) bool {
+		t_.Insert(_p("10.2.0.0/16"), "c")
+		return true
+	}))
+	assert.NotNil(t, m.Apply(TableX{}.Changeset(m.Table())))
+	m.InsertOrUpdate(_p("10.0.0.0/8"), "d")
+	m.InsertOrUpdate(_p("10.3.0.0/16"), "d")
+	m.RemoveSet(_p("10.0.0.0/9"))
+	assert.Nil(t, m.GetOrInsert(_p("10.4.0.0/16"), "e"))
+	assert.Equal(t, "a", m.GetOrInsert(_p("10.0.0.0/8"), "e"))
+	assert.Equal(t, int64(1), m.NumEntries())
+	value, _ := m.Get(_p("10.0.0.0/8"))
+	assert.Equal(t, "a", value)
+	assert.NotNil(t, j.Err())
+	assert.Equal(t, uint64(1), history.Version())
+	assert.NotNil(t, j.Close())
+
+	// Everything that was made visible is in the journal
+	recovered := NewTableX_()
+	require.Nil(t, recovered.Recover(bytes.NewReader(w.Bytes()), decodeJSON))
+	assert.True(t, recovered.Table().trie.Equal(m.Table().trie, ieq))
+}
+
+func TestJournalRecordTooLong(t *testing.T) {
+	header := []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}
+	assert.NotNil(t, NewTableX_().Recover(bytes.NewReader(header), decodeJSON))
+	assert.NotNil(t, NewSet_().Recover(bytes.NewReader(header)))
+}
+
+func TestSetJournal(t *testing.T) {
+	s := NewSet_()
+	s.Insert(_p("10.0.0.0/8"))
+
+	var buf bytes.Buffer
+	j, err := s.Journal(&buf, JournalOptions{})
+	require.Nil(t, err)
+
+	s.Remove(_p("10.1.0.0/16"))
+	s.Insert(_r(_a("192.168.0.7"), _a("192.168.3.200")))
+	s.Remove(_a("192.168.1.1"))
+	assert.Nil(t, j.Err())
+
+	recovered := NewSet_()
+	require.Nil(t, recovered.Recover(bytes.NewReader(buf.Bytes())))
+	assert.True(t, recovered.Equal(s))
+
+	for i := 1; i < buf.Len(); i++ {
+		torn := NewSet_()
+		require.Nil(t, torn.Recover(bytes.NewReader(buf.Bytes()[:i])), i)
+		assert.True(t, torn.isValid())
+	}
+
+	var compacted bytes.Buffer
+	require.Nil(t, j.Compact(&compacted))
+	assert.Nil(t, j.Close())
+	recovered = NewSet_()
+	require.Nil(t, recovered.Recover(&compacted))
+	assert.True(t, recovered.Equal(s))
+}
+
+func TestSetJournalWriteAhead(t *testing.T) {
+	s := NewSet_()
+	w := &limitedWriter{n: 2}
+	j, err := s.Journal(w, JournalOptions{})
+	require.Nil(t, err)
+	_, err = s.Journal(w, JournalOptions{})
+	assert.NotNil(t, err)
+
+	s.Insert(_p("10.0.0.0/8"))
+	assert.Nil(t, j.Err())
+
+	// Neither of these can be written so both leave the set unchanged
+	s.Insert(_p("192.168.0.0/16"))
+	assert.NotNil(t, j.Err())
+	s.Remove(_p("10.0.0.0/16"))
+	assert.True(t, s.Set().Equal(_p("10.0.0.0/8").Set()))
+	assert.NotNil(t, j.Close())
+
+	recovered := NewSet_()
+	require.Nil(t, recovered.Recover(bytes.NewReader(w.Bytes())))
+	assert.True(t, recovered.Equal(s))
+
+	// Modifications work again after closing
+	s.Insert(_p("192.168.0.0/16"))
+	assert.Equal(t, int64(1<<24+1<<16), s.NumAddresses())
+}
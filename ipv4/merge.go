@@ -0,0 +1,84 @@
+package ipv4
+
+// TableXConflict describes a prefix that was changed differently in two tables
+// derived from the same base. For each of the three tables, the value is only
+// meaningful if the corresponding In* field is true; otherwise, the prefix is
+// absent from that table.
+type TableXConflict struct {
+	Prefix                   Prefix
+	Base, Ours, Theirs       interface{}
+	InBase, InOurs, InTheirs bool
+}
+
+// ThreeWayMerge reconciles two tables, ours and theirs, that were both derived
+// from base. Every change made in theirs (relative to base) is applied to ours
+// unless ours also changed the same prefix to something different. Those
+// prefixes are left as they are in ours and reported as conflicts in
+// lexigraphical order. Changes made only in ours are kept as they are.
+//
+// Values are compared using ours' comparator.
+func ThreeWayMerge(base, ours, theirs TableX) (merged TableX, conflicts []TableXConflict) {
+	if ours.eq == nil {
+		ours.eq = defaultComparator
+	}
+
+	get := func(t TableX, p Prefix) (interface{}, bool) {
+		node := t.trie.Match(p)
+		if node == nil || node.Prefix.length != p.length {
+			return nil, false
+		}
+		return node.Data, true
+	}
+	same := func(a interface{}, aOk bool, b interface{}, bOk bool) bool {
+		if aOk != bOk {
+			return false
+		}
+		return !aOk || ours.eq(a, b)
+	}
+
+	merged = ours.Build(func(m_ TableX_) bool {
+		reconcile := func(p Prefix) bool {
+			baseValue, inBase := get(base, p)
+			ourValue, inOurs := get(ours, p)
+			theirValue, inTheirs := get(theirs, p)
+
+			switch {
+			case same(ourValue, inOurs, theirValue, inTheirs):
+				// Both sides made the same change
+			case same(ourValue, inOurs, baseValue, inBase):
+				// Only theirs changed it
+				if inTheirs {
+					m_.InsertOrUpdate(p, theirValue)
+				} else {
+					m_.Remove(p)
+				}
+			default:
+				conflicts = append(conflicts, TableXConflict{
+					Prefix:   p,
+					Base:     baseValue,
+					Ours:     ourValue,
+					Theirs:   theirValue,
+					InBase:   inBase,
+					InOurs:   inOurs,
+					InTheirs: inTheirs,
+				})
+			}
+			return true
+		}
+
+		TableX{base.trie, ours.eq}.Diff(theirs,
+			func(p Prefix, _, _ interface{}) bool {
+				return reconcile(p)
+			},
+			func(p Prefix, _ interface{}) bool {
+				return reconcile(p)
+			},
+			func(p Prefix, _ interface{}) bool {
+				return reconcile(p)
+			},
+			nil,
+		)
+		return true
+	})
+	return merged, conflicts
+}
@@ -0,0 +1,85 @@
+package ipv4
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThreeWayMerge(t *testing.T) {
+	base := TableX{}.Build(func(t_ TableX_) bool {
+		t_.Insert(_p("10.0.0.0/8"), 1)
+		t_.Insert(_p("10.1.0.0/16"), 2)
+		t_.Insert(_p("10.2.0.0/16"), 3)
+		t_.Insert(_p("10.3.0.0/16"), 4)
+		t_.Insert(_p("10.4.0.0/16"), 5)
+		return true
+	})
+
+	ours := base.Build(func(t_ TableX_) bool {
+		t_.Update(_p("10.1.0.0/16"), 20)   // only ours
+		t_.Update(_p("10.2.0.0/16"), 30)   // both, same
+		t_.Update(_p("10.3.0.0/16"), 40)   // both, different
+		t_.Remove(_p("10.4.0.0/16"))       // ours removes, theirs modifies
+		t_.Insert(_p("10.5.0.0/16"), 60)   // both insert, different
+		t_.Insert(_p("192.168.0.0/16"), 7) // only ours
+		return true
+	})
+
+	theirs := base.Build(func(t_ TableX_) bool {
+		t_.Update(_p("10.0.0.0/8"), 10)   // only theirs
+		t_.Update(_p("10.2.0.0/16"), 30)  // both, same
+		t_.Update(_p("10.3.0.0/16"), 41)  // both, different
+		t_.Update(_p("10.4.0.0/16"), 50)  // ours removes, theirs modifies
+		t_.Insert(_p("10.5.0.0/16"), 61)  // both insert, different
+		t_.Insert(_p("172.16.0.0/12"), 8) // only theirs
+		return true
+	})
+
+	merged, conflicts := ThreeWayMerge(base, ours, theirs)
+
+	entries := map[string]interface{}{}
+	merged.Walk(func(p Prefix, v interface{}) bool {
+		entries[p.String()] = v
+		return true
+	})
+	assert.Equal(t, map[string]interface{}{
+		"10.0.0.0/8":     10,
+		"10.1.0.0/16":    20,
+		"10.2.0.0/16":    30,
+		"10.3.0.0/16":    40,
+		"10.5.0.0/16":    60,
+		"172.16.0.0/12":  8,
+		"192.168.0.0/16": 7,
+	}, entries)
+
+	assert.Equal(t, []TableXConflict{
+		TableXConflict{
+			Prefix: _p("10.3.0.0/16"),
+			Base:   4, Ours: 40, Theirs: 41,
+			InBase: true, InOurs: true, InTheirs: true,
+		},
+		TableXConflict{
+			Prefix: _p("10.4.0.0/16"),
+			Base:   5, Theirs: 50,
+			InBase: true, InTheirs: true,
+		},
+		TableXConflict{
+			Prefix: _p("10.5.0.0/16"),
+			Ours:   60, Theirs: 61,
+			InOurs: true, InTheirs: true,
+		},
+	}, conflicts)
+
+	t.Run("no_changes", func(t *testing.T) {
+		merged, conflicts := ThreeWayMerge(base, base, base)
+		assert.Empty(t, conflicts)
+		assert.True(t, merged.trie == base.trie)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		merged, conflicts := ThreeWayMerge(TableX{}, TableX{}, theirs)
+		assert.Empty(t, conflicts)
+		assert.True(t, merged.trie.Equal(theirs.trie, ieq))
+	})
+}
@@ -3,6 +3,7 @@ package ipv4
 import (
 	"fmt"
 	"math/bits"
+	"sort"
 )
 
 type trieNode struct {
@@ -11,7 +12,10 @@ type trieNode struct {
 	size     uint32
 	h        uint16
 	isActive bool
-	children [2]*trieNode
+	// numAddresses is the number of addresses covered by active nodes in
+	// this subtrie. It is kept up to date by mutate().
+	numAddresses uint64
+	children     [2]*trieNode
 }
 
 func intMin(a, b int) int {
@@ -113,9 +117,26 @@ func (me *trieNode) mutate(mutator func(*trieNode)) *trieNode {
 	if me.isActive {
 		me.size++
 	}
+	me.numAddresses = me.countAddresses()
 	return me
 }
 
+// countAddresses counts the addresses covered by active nodes in this subtrie
+// given that the counts in its children are up to date.
+func (me *trieNode) countAddresses() uint64 {
+	if me.isActive {
+		return uint64(me.Prefix.NumAddresses())
+	}
+	return me.children[0].numAddressesOrZero() + me.children[1].numAddressesOrZero()
+}
+
+func (me *trieNode) numAddressesOrZero() uint64 {
+	if me == nil {
+		return 0
+	}
+	return me.numAddresses
+}
+
 func (me *trieNode) copyMutate(mutator func(*trieNode)) *trieNode {
 	if me == nil {
 		return nil
@@ -239,18 +260,11 @@ func (me *trieNode) Match(searchKey Prefix) *trieNode {
 	return me
 }
 
-// NumAddresses returns the number of addresses that could match this node Note
-// that this may have to search all nodes recursively to find the answer. The
-// implementation can be changed to store the size in each node at the cost of
-// adding about 8 more bytes to the size of each node.
+// NumAddresses returns the number of addresses that could match this node. It
+// takes constant time because the count is stored in each node. The count is
+// kept in 64 bits; an IPv4 trie can cover up to 2^32 addresses.
 func (me *trieNode) NumAddresses() int64 {
-	if me == nil {
-		return 0
-	}
-	if me.isActive {
-		return int64(^me.Prefix.Mask().Uint32()) + 1
-	}
-	return me.children[0].NumAddresses() + me.children[1].NumAddresses()
+	return int64(me.numAddressesOrZero())
 }
 
 // NumNodes returns the number of entries in the trie
@@ -292,6 +306,9 @@ func (me *trieNode) isValidLen(minLen uint32) bool {
 	if size != uint32(left.NumNodes()+right.NumNodes()) {
 		return false
 	}
+	if me.numAddresses != me.countAddresses() {
+		return false
+	}
 	if me.h != 1+uint16(uint16(intMax(left.height(), right.height()))) {
 		return false
 	}
@@ -324,40 +341,8 @@ func (me *trieNode) Insert(key Prefix, data interface{}) (newHead *trieNode, err
 }
 
 type insertOpts struct {
-	insert, update, flatten bool
-	eq                      comparator
-}
-
-// flatten assumes that `me` is a new node. It should not be called that had
-// already existed as a node in the trie because it does not make a copy.
-func (me *trieNode) flatten() {
-	if me.isActive {
-		// If the current node is active, then anything referenced by the
-		// children is redundant, they can be removed.
-		me.children = [2]*trieNode{}
-		return
-	}
-	left, right := me.children[0], me.children[1]
-	if left == nil || right == nil {
-		panic("this should never happen; it means that the structure is not optimized")
-	}
-	if left.Prefix.length != right.Prefix.length {
-		// If the childen have different size prefixes, then we cannot combine
-		// them. Do nothing.
-		return
-	}
-	if left.Prefix.length != me.Prefix.length+1 {
-		// If the children aren't exactly half the current node's prefix then
-		// we cannot combine them. Do nothing.
-		return
-	}
-	if !left.isActive || !right.isActive {
-		// If the children aren't both active, it means they are sparse and
-		// cannot be combined. Do nothing.
-		return
-	}
-	me.children = [2]*trieNode{}
-	me.isActive = true
+	insert, update bool
+	eq             comparator
 }
 
 // insert adds a node into the trie and return the new root of the trie. It is
@@ -385,36 +370,22 @@ func (me *trieNode) insert(node *trieNode, opts insertOpts) (newHead *trieNode,
 		if !me.isActive && !opts.insert {
 			return me, fmt.Errorf("the key doesn't exist to update")
 		}
-		if opts.flatten {
-			// avoid copy-on-write when it will be flattened resulting in no effective change
-			return me, nil
-		}
 		return node.mutate(func(n *trieNode) {
 			if me.isActive && opts.eq(me.Data, node.Data) {
 				node.Data = me.Data
 			}
 			n.children = me.children
 			n.isActive = true
-			if opts.flatten {
-				n.flatten()
-			}
 		}), nil
 
 	case compareContains:
 		// Trie node's key contains the new node's key. Insert it recursively.
-		if opts.flatten && me.isActive {
-			// avoid copy-on-write when it will be flattened resulting in no effective change
-			return me, nil
-		}
 		newChild, err := me.children[child].insert(node, opts)
 		if err != nil {
 			return me, err
 		}
 		newNode := me.copyMutate(func(n *trieNode) {
 			n.children[child] = newChild
-			if opts.flatten {
-				n.flatten()
-			}
 		})
 		return newNode, nil
 
@@ -426,9 +397,6 @@ func (me *trieNode) insert(node *trieNode, opts insertOpts) (newHead *trieNode,
 		node = node.mutate(func(n *trieNode) {
 			n.children[child] = me
 			n.isActive = true
-			if opts.flatten {
-				n.flatten()
-			}
 		})
 		return node, nil
 
@@ -457,44 +425,30 @@ func (me *trieNode) insert(node *trieNode, opts insertOpts) (newHead *trieNode,
 			},
 			children: children,
 		}
-		newNode.mutate(func(n *trieNode) {
-			if opts.flatten {
-				n.flatten()
-			}
-		})
+		newNode.mutate(func(*trieNode) {})
 		return newNode, nil
 	}
 	panic("unreachable code")
 }
 
-type deleteOpts struct {
-	flatten bool
-}
-
 // Delete removes a node from the trie given a key and returns the new root of
 // the trie. It is important to note that the root of the trie can change.
 func (me *trieNode) Delete(key Prefix) (newHead *trieNode, err error) {
-	return me.del(key, deleteOpts{})
+	return me.del(key)
 }
 
 func reverseChild(child int) int {
 	return (child + 1) % 2
 }
 
-func (me *trieNode) del(key Prefix, opts deleteOpts) (newHead *trieNode, err error) {
+func (me *trieNode) del(key Prefix) (newHead *trieNode, err error) {
 	if me == nil {
-		if opts.flatten {
-			return nil, nil
-		}
 		return me, fmt.Errorf("cannot delete from a nil")
 	}
 
 	result, _, _, child := compare(me.Prefix, key)
 	switch result {
 	case compareSame:
-		if opts.flatten {
-			return nil, nil
-		}
 		// Delete this node
 		if me.children[0] == nil {
 			// At this point, it doesn't matter if it is nil or not
@@ -512,23 +466,8 @@ func (me *trieNode) del(key Prefix, opts deleteOpts) (newHead *trieNode, err err
 		return newNode, nil
 
 	case compareContains:
-		if me.isActive && opts.flatten {
-			// TODO This is for sets. Break it out of here.
-			// split this prefix into ranges and insert them
-			super, sub := me.Prefix.Range(), key.Range()
-			remainingRanges := super.Minus(sub)
-			var s *setNode
-			if len(remainingRanges) == 1 {
-				s = setNodeFromRange(remainingRanges[0])
-			} else {
-				a := setNodeFromRange(remainingRanges[0])
-				b := setNodeFromRange(remainingRanges[1])
-				s = a.Union(b)
-			}
-			return (*trieNode)(s), nil
-		}
 		// Delete recursively.
-		newChild, err := me.children[child].del(key, opts)
+		newChild, err := me.children[child].del(key)
 		if err != nil {
 			return me, err
 		}
@@ -543,9 +482,6 @@ func (me *trieNode) del(key Prefix, opts deleteOpts) (newHead *trieNode, err err
 		return newNode, nil
 
 	case compareIsContained:
-		if opts.flatten {
-			return nil, nil
-		}
 		return me, fmt.Errorf("key not found")
 
 	case compareDisjoint:
@@ -824,6 +760,93 @@ func (me *trieNode) Aggregate(eq comparator) *trieNode {
 	return me.aggregate(nil, eq)
 }
 
+// aggregateWith returns the entries of the trie, in lexigraphical order, after
+// folding values together from the bottom up. The values of two entries which
+// are the halves of a prefix are folded into a new entry for that prefix and
+// the value of an entry is folded into the nearest entry that contains it,
+// whenever shouldMerge allows it.
+func (me *trieNode) aggregateWith(combine func(a, b interface{}) interface{}, shouldMerge func(p Prefix, a, b interface{}) bool) []TableXEntry {
+	if me == nil {
+		return nil
+	}
+
+	left := me.children[0].aggregateWith(combine, shouldMerge)
+	right := me.children[1].aggregateWith(combine, shouldMerge)
+
+	if me.isActive {
+		return foldEntries(TableXEntry{me.Prefix, me.Data}, append(left, right...), combine, shouldMerge)
+	}
+
+	lower, upper := me.Prefix.Halves()
+	if len(left) != 0 && len(right) != 0 && left[0].Prefix.Network() == lower && right[0].Prefix.Network() == upper {
+		if shouldMerge(me.Prefix, left[0].Value, right[0].Value) {
+			top := TableXEntry{me.Prefix, combine(left[0].Value, right[0].Value)}
+			return foldEntries(top, append(left[1:], right[1:]...), combine, shouldMerge)
+		}
+	}
+	return append(left, right...)
+}
+
+// disaggregate appends non-overlapping entries covering the addresses in p,
+// which must contain this subtrie, in lexigraphical order. Each address gets
+// the value of its longest match in the subtrie or else the umbrella's value,
+// if there is one.
+func (me *trieNode) disaggregate(p Prefix, u *umbrella, entries []TableXEntry) []TableXEntry {
+	var empty *trieNode
+	switch {
+	case me == nil:
+		if u != nil {
+			entries = append(entries, TableXEntry{p, u.Data})
+		}
+		return entries
+
+	case p.length < me.Prefix.length:
+		// Split p until the half that contains this node matches it exactly
+		lower, upper := p.Halves()
+		if _, _, _, child := contains(p, me.Prefix); child == 0 {
+			entries = me.disaggregate(lower, u, entries)
+			return empty.disaggregate(upper, u, entries)
+		}
+		entries = empty.disaggregate(lower, u, entries)
+		return me.disaggregate(upper, u, entries)
+	}
+
+	if me.isActive {
+		u = &umbrella{me.Data}
+	}
+	if me.children[0] == nil && me.children[1] == nil {
+		return empty.disaggregate(p, u, entries)
+	}
+	lower, upper := p.Halves()
+	entries = me.children[0].disaggregate(lower, u, entries)
+	return me.children[1].disaggregate(upper, u, entries)
+}
+
+// foldEntries folds the values of the given entries, which are all contained
+// in top, into it where shouldMerge allows. It returns top followed by the
+// entries that are left.
+func foldEntries(top TableXEntry, entries []TableXEntry, combine func(a, b interface{}) interface{}, shouldMerge func(p Prefix, a, b interface{}) bool) []TableXEntry {
+	result := []TableXEntry{top}
+	// kept holds the entries kept so far that contain the current one
+	var kept []Prefix
+	for _, e := range entries {
+		for len(kept) != 0 {
+			last := kept[len(kept)-1]
+			if matches, _, _, _ := contains(last, e.Prefix); matches && last.length <= e.Prefix.length {
+				break
+			}
+			kept = kept[:len(kept)-1]
+		}
+		if len(kept) == 0 && shouldMerge(top.Prefix, result[0].Value, e.Value) {
+			result[0].Value = combine(result[0].Value, e.Value)
+			continue
+		}
+		result = append(result, e)
+		kept = append(kept, e.Prefix)
+	}
+	return result
+}
+
 // Map runs the given mapper function on every data value in the table and
 // returns the *trieNode pointing to the result. As always, the original
 // structure is not modified, an entirely new structure is created.
@@ -839,3 +862,172 @@ func (me *trieNode) Map(mapper func(Prefix, interface{}) interface{}, eq compara
 		}
 	})
 }
+
+// Filter returns a trie containing only the active nodes for which the given
+// predicate returns true. The predicate is called for each active node in
+// lexigraphical order. Subtries where nothing is filtered out are shared with
+// the original structure, which is not modified.
+func (me *trieNode) Filter(predicate func(Prefix, interface{}) bool) *trieNode {
+	if me == nil {
+		return nil
+	}
+
+	isActive := me.isActive && predicate(me.Prefix, me.Data)
+	return me.replace(isActive, [2]*trieNode{
+		me.children[0].Filter(predicate),
+		me.children[1].Filter(predicate),
+	})
+}
+
+// replace returns this node with the given activity and children, which must
+// each be the same as or a filtered version of the existing one. The node is
+// dropped if it would be an inactive node joining less than two children.
+func (me *trieNode) replace(isActive bool, children [2]*trieNode) *trieNode {
+	if !isActive {
+		// An inactive node is only needed to join two children
+		if children[0] == nil {
+			return children[1]
+		}
+		if children[1] == nil {
+			return children[0]
+		}
+	}
+
+	if isActive == me.isActive && children == me.children {
+		return me
+	}
+	return me.copyMutate(func(n *trieNode) {
+		n.isActive = isActive
+		if !isActive {
+			n.Data = nil
+		}
+		n.children = children
+	})
+}
+
+// RemoveSet removes all of the addresses in the given set from the trie while
+// preserving the longest prefix match for every address outside of it. Nodes
+// entirely inside the set are removed. Nodes that only partially overlap it
+// are split into the smallest set of prefixes covering what remains and each
+// fragment carries the data of the node it was split from. A fragment never
+// replaces an existing node with the same key; the more specific original
+// wins.
+func (me *trieNode) RemoveSet(hole *setNode) *trieNode {
+	if me == nil || hole == nil {
+		return me
+	}
+
+	var split []trieFragments
+	result := me.punch(hole, &split)
+
+	// Insert fragments from the most specific nodes first so that, where two
+	// fragments share a key, the one carrying the longest match wins.
+	sort.SliceStable(split, func(i, j int) bool {
+		return split[i].length > split[j].length
+	})
+	for _, f := range split {
+		f.remaining.Walk(func(p Prefix) bool {
+			if newHead, err := result.Insert(p, f.data); err == nil {
+				result = newHead
+			}
+			return true
+		})
+	}
+	return result
+}
+
+// trieFragments is what remains of an entry that only partially overlaps a
+// hole punched by RemoveSet
+type trieFragments struct {
+	length    uint32
+	data      interface{}
+	remaining *setNode
+}
+
+// punch removes every entry that overlaps the hole, appending the remains of
+// the ones that only partially overlap it to split. Subtries that don't
+// overlap the hole are kept without visiting their entries.
+func (me *trieNode) punch(hole *setNode, split *[]trieFragments) *trieNode {
+	if me == nil || !hole.overlaps(me.Prefix) {
+		return me
+	}
+	if me.isActive {
+		whole := setNodeFromPrefix(me.Prefix)
+		if overlap := hole.Intersect(whole); overlap.NumAddresses() != whole.NumAddresses() {
+			*split = append(*split, trieFragments{
+				length:    me.Prefix.length,
+				data:      me.Data,
+				remaining: whole.Difference(overlap),
+			})
+		}
+	}
+	return me.replace(false, [2]*trieNode{
+		me.children[0].punch(hole, split),
+		me.children[1].punch(hole, split),
+	})
+}
+
+// Nth returns the active node at the given index in the order that Walk visits
+// them or nil if the index is out of range. It takes time proportional to the
+// height of the trie.
+func (me *trieNode) Nth(index int64) *trieNode {
+	if me == nil || index < 0 || index >= me.NumNodes() {
+		return nil
+	}
+	if me.isActive {
+		if index == 0 {
+			return me
+		}
+		index--
+	}
+	if left := me.children[0].NumNodes(); index >= left {
+		return me.children[1].Nth(index - left)
+	}
+	return me.children[0].Nth(index)
+}
+
+// Rank returns the number of active nodes that Walk visits before reaching the
+// given key, whether the key exists in the trie or not. It takes time
+// proportional to the height of the trie.
+func (me *trieNode) Rank(key Prefix) int64 {
+	if me == nil {
+		return 0
+	}
+	result, _, _, child := compare(me.Prefix, key)
+	switch result {
+	case compareContains:
+		var rank int64
+		if me.isActive {
+			rank++
+		}
+		if child == 1 {
+			return rank + me.children[0].NumNodes() + me.children[1].Rank(key)
+		}
+		return rank + me.children[0].Rank(key)
+
+	case compareDisjoint:
+		if me.Prefix.Network().addr.lessThan(key.Network().addr) {
+			return me.NumNodes()
+		}
+	}
+	// The key comes before everything in this subtrie
+	return 0
+}
+
+// WalkReverse is like Walk but visits the active nodes in exactly the opposite
+// order.
+func (me *trieNode) WalkReverse(callback func(Prefix, interface{}) bool) bool {
+	if me == nil {
+		return true
+	}
+	if !me.children[1].WalkReverse(callback) {
+		return false
+	}
+	if !me.children[0].WalkReverse(callback) {
+		return false
+	}
+	if me.isActive {
+		return callback(me.Prefix, me.Data)
+	}
+	return true
+}
@@ -49,10 +49,11 @@ func TestStructSizes(t *testing.T) {
 		),
 		keySize,
 	)
+	// Caching the number of addresses in each node costs 8 bytes.
 	assert.Equal(t,
 		intMin(
-			48,
-			keySize+6*nodeAlign,
+			56,
+			keySize+8*nodeAlign,
 		),
 		nodeSize,
 	)
@@ -1569,128 +1570,6 @@ func TestTrieNodeEqual(t *testing.T) {
 	}
 }
 
-func TestFlatten(t *testing.T) {
-	t.Run("active node needs no children", func(t *testing.T) {
-		prefix := _p("1.2.3.0/24")
-		n := trieNode{
-			Prefix:   prefix,
-			isActive: true,
-			children: [2]*trieNode{
-				&trieNode{},
-				&trieNode{},
-			},
-		}
-		n.flatten()
-		assert.Equal(t, prefix, n.Prefix)
-		assert.True(t, n.isActive)
-		assert.Nil(t, n.children[0])
-		assert.Nil(t, n.children[1])
-	})
-	t.Run("children of unequal size", func(t *testing.T) {
-		prefix := _p("1.2.3.0/24")
-		left := _p("1.2.3.0/26")
-		right := _p("1.2.3.128/25")
-		n := trieNode{
-			Prefix: prefix,
-			children: [2]*trieNode{
-				&trieNode{Prefix: left},
-				&trieNode{Prefix: right},
-			},
-		}
-		n.flatten()
-		assert.Equal(t, prefix, n.Prefix)
-		assert.False(t, n.isActive)
-		assert.Equal(t, left, n.children[0].Prefix)
-		assert.Equal(t, right, n.children[1].Prefix)
-	})
-	t.Run("children smaller than half", func(t *testing.T) {
-		prefix := _p("1.2.3.0/24")
-		left := _p("1.2.3.0/26")
-		right := _p("1.2.3.128/26")
-		n := trieNode{
-			Prefix: prefix,
-			children: [2]*trieNode{
-				&trieNode{Prefix: left},
-				&trieNode{Prefix: right},
-			},
-		}
-		n.flatten()
-		assert.Equal(t, prefix, n.Prefix)
-		assert.False(t, n.isActive)
-		assert.Equal(t, left, n.children[0].Prefix)
-		assert.Equal(t, right, n.children[1].Prefix)
-	})
-
-	t.Run("children not both active (left)", func(t *testing.T) {
-		prefix := _p("1.2.3.0/24")
-		left := _p("1.2.3.0/25")
-		right := _p("1.2.3.128/25")
-		n := trieNode{
-			Prefix: prefix,
-			children: [2]*trieNode{
-				&trieNode{
-					Prefix:   left,
-					isActive: true,
-				},
-				&trieNode{
-					Prefix: right,
-				},
-			},
-		}
-		n.flatten()
-		assert.Equal(t, prefix, n.Prefix)
-		assert.False(t, n.isActive)
-		assert.Equal(t, left, n.children[0].Prefix)
-		assert.Equal(t, right, n.children[1].Prefix)
-	})
-
-	t.Run("children not both active (right)", func(t *testing.T) {
-		prefix := _p("1.2.3.0/24")
-		left := _p("1.2.3.0/25")
-		right := _p("1.2.3.128/25")
-		n := trieNode{
-			Prefix: prefix,
-			children: [2]*trieNode{
-				&trieNode{
-					Prefix: left,
-				},
-				&trieNode{
-					Prefix:   right,
-					isActive: true,
-				},
-			},
-		}
-		n.flatten()
-		assert.Equal(t, prefix, n.Prefix)
-		assert.False(t, n.isActive)
-		assert.Equal(t, left, n.children[0].Prefix)
-		assert.Equal(t, right, n.children[1].Prefix)
-	})
-	t.Run("children both active", func(t *testing.T) {
-		prefix := _p("1.2.3.0/24")
-		left := _p("1.2.3.0/25")
-		right := _p("1.2.3.128/25")
-		n := trieNode{
-			Prefix: prefix,
-			children: [2]*trieNode{
-				&trieNode{
-					Prefix:   left,
-					isActive: true,
-				},
-				&trieNode{
-					Prefix:   right,
-					isActive: true,
-				},
-			},
-		}
-		n.flatten()
-		assert.Equal(t, prefix, n.Prefix)
-		assert.True(t, n.isActive)
-		assert.Nil(t, n.children[0])
-		assert.Nil(t, n.children[1])
-	})
-}
-
 type actionType int
 
 const (
@@ -2222,3 +2101,95 @@ func TestNewAggregate(t *testing.T) {
 		})
 	}
 }
+
+func TestFilter(t *testing.T) {
+	fill := func(prefixes []Prefix) (trie *trieNode) {
+		var err error
+		for _, p := range prefixes {
+			trie, err = trie.Insert(p, p.Length())
+			require.Nil(t, err)
+		}
+		return
+	}
+
+	tests := []struct {
+		desc             string
+		original, result []Prefix
+		predicate        func(Prefix, interface{}) bool
+	}{
+		{
+			desc:      "empty",
+			predicate: func(Prefix, interface{}) bool { return false },
+		}, {
+			desc: "keep_all",
+			original: []Prefix{
+				Prefix{_a("203.0.113.0"), 24},
+				Prefix{_a("203.0.113.0"), 32},
+				Prefix{_a("192.0.2.0"), 27},
+			},
+			result: []Prefix{
+				Prefix{_a("203.0.113.0"), 24},
+				Prefix{_a("203.0.113.0"), 32},
+				Prefix{_a("192.0.2.0"), 27},
+			},
+			predicate: func(Prefix, interface{}) bool { return true },
+		}, {
+			desc: "remove_all",
+			original: []Prefix{
+				Prefix{_a("203.0.113.0"), 24},
+				Prefix{_a("203.0.113.0"), 32},
+				Prefix{_a("192.0.2.0"), 27},
+			},
+			predicate: func(Prefix, interface{}) bool { return false },
+		}, {
+			desc: "remove_parent",
+			original: []Prefix{
+				Prefix{_a("198.51.100.0"), 24},
+				Prefix{_a("198.51.100.0"), 25},
+				Prefix{_a("198.51.100.128"), 26},
+			},
+			result: []Prefix{
+				Prefix{_a("198.51.100.0"), 25},
+				Prefix{_a("198.51.100.128"), 26},
+			},
+			predicate: func(p Prefix, _ interface{}) bool { return p.Length() != 24 },
+		}, {
+			desc: "promote_remaining_child",
+			original: []Prefix{
+				Prefix{_a("198.51.100.0"), 25},
+				Prefix{_a("198.51.100.128"), 26},
+				Prefix{_a("198.51.100.128"), 27},
+				Prefix{_a("198.51.100.160"), 27},
+			},
+			result: []Prefix{
+				Prefix{_a("198.51.100.128"), 27},
+				Prefix{_a("198.51.100.160"), 27},
+			},
+			predicate: func(p Prefix, _ interface{}) bool { return p.Length() == 27 },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			original, expected := fill(tt.original), fill(tt.result)
+			result := original.Filter(tt.predicate)
+			assert.True(t, result.isValid())
+			assert.True(t, expected.Equal(result, ieq))
+			assert.Equal(t, int64(len(tt.original)), original.NumNodes())
+		})
+	}
+
+	t.Run("shares_unchanged", func(t *testing.T) {
+		original := fill([]Prefix{
+			Prefix{_a("192.0.2.0"), 24},
+			Prefix{_a("192.0.2.0"), 25},
+			Prefix{_a("203.0.113.0"), 24},
+			Prefix{_a("203.0.113.0"), 25},
+		})
+		result := original.Filter(func(p Prefix, _ interface{}) bool {
+			return p.Prefix().Address().ui>>24 == 192
+		})
+		assert.True(t, result == original.children[0])
+		assert.True(t, original.Filter(func(Prefix, interface{}) bool { return true }) == original)
+	})
+}
@@ -0,0 +1,187 @@
+package ipv4
+
+// overlayRegion is a prefix over which the longest match in each of two tables
+// doesn't change. Each umbrella is nil if there is no match on that side.
+type overlayRegion struct {
+	Prefix      Prefix
+	left, right *umbrella
+}
+
+// value returns the umbrella's value or false if there isn't one
+func (me *umbrella) value() (interface{}, bool) {
+	if me == nil {
+		return nil, false
+	}
+	return me.Data, true
+}
+
+// halvesIn returns the parts of this subtrie, which must be contained in p,
+// that are in each half of p. If this node's prefix is p and it is an entry,
+// its value becomes the new umbrella for everything under it.
+func (me *trieNode) halvesIn(p Prefix, u *umbrella) ([2]*trieNode, *umbrella) {
+	if me == nil {
+		return [2]*trieNode{}, u
+	}
+	if me.Prefix.length == p.length {
+		if me.isActive {
+			u = &umbrella{me.Data}
+		}
+		return me.children, u
+	}
+	var halves [2]*trieNode
+	_, _, _, child := contains(p, me.Prefix)
+	halves[child] = me
+	return halves, u
+}
+
+// overlay appends the regions within p, which contains both subtries, in
+// lexigraphical order. Prefixes are split only as far as needed to separate
+// the entries in either subtrie.
+func overlay(p Prefix, left, right *trieNode, lu, ru *umbrella, regions []overlayRegion) []overlayRegion {
+	leftHalves, lu := left.halvesIn(p, lu)
+	rightHalves, ru := right.halvesIn(p, ru)
+	if leftHalves == [2]*trieNode{} && rightHalves == [2]*trieNode{} {
+		if lu != nil || ru != nil {
+			regions = append(regions, overlayRegion{p, lu, ru})
+		}
+		return regions
+	}
+	lower, upper := p.Halves()
+	regions = overlay(lower, leftHalves[0], rightHalves[0], lu, ru, regions)
+	return overlay(upper, leftHalves[1], rightHalves[1], lu, ru, regions)
+}
+
+// overlayRegions returns the fewest non-overlapping regions, in lexigraphical
+// order, over which neither table's longest match changes. Regions matched by
+// neither table are left out.
+func overlayRegions(left, right TableX) []overlayRegion {
+	leftEq, rightEq := left.eq, right.eq
+	if leftEq == nil {
+		leftEq = defaultComparator
+	}
+	if rightEq == nil {
+		rightEq = defaultComparator
+	}
+	same := func(a, b *umbrella, eq comparator) bool {
+		if a == nil || b == nil {
+			return a == b
+		}
+		return a == b || eq(a.Data, b.Data)
+	}
+
+	var merged []overlayRegion
+	for _, r := range overlay(Prefix{}, left.trie, right.trie, nil, nil, nil) {
+		merged = append(merged, r)
+		// Join the last two regions while they are the halves of a prefix
+		// and match the same on both sides
+		for len(merged) >= 2 {
+			a, b := merged[len(merged)-2], merged[len(merged)-1]
+			if a.Prefix.length != b.Prefix.length || a.Prefix.length == 0 {
+				break
+			}
+			parent := Prefix{a.Prefix.addr, a.Prefix.length - 1}.Network()
+			if lower, upper := parent.Halves(); a.Prefix != lower || b.Prefix != upper {
+				break
+			}
+			if !same(a.left, b.left, leftEq) || !same(a.right, b.right, rightEq) {
+				break
+			}
+			merged = append(merged[:len(merged)-2], overlayRegion{parent, a.left, a.right})
+		}
+	}
+	return merged
+}
+
+// Overlay visits, in lexigraphical order, the fewest non-overlapping prefixes
+// needed to cover every address matched by either table such that the longest
+// match in each table is the same for every address in a prefix. For each
+// one, the callback gets the value that LongestMatch returns in each table.
+// The value from a table is only meaningful if the corresponding ok is true;
+// otherwise, it has no match there. Values are compared using each table's
+// comparator to avoid splitting prefixes where neither side's value changes.
+//
+// This is useful for comparing two tables covering the same address space,
+// like a policy table and a routing table. It stops iteration immediately if
+// callback returns false.
+//
+// It returns false if iteration was stopped due to a callback return false or
+// true if it iterated all items.
+func Overlay(left, right TableX, callback func(p Prefix, l, r interface{}, lok, rok bool) bool) bool {
+	for _, region := range overlayRegions(left, right) {
+		l, lok := region.left.value()
+		r, rok := region.right.value()
+		if !callback(region.Prefix, l, r, lok, rok) {
+			return false
+		}
+	}
+	return true
+}
+
+// EffectiveDiff visits, in lexigraphical order, the ranges of addresses for
+// which LongestMatch returns something different in the two tables. Unlike
+// Diff, it ignores differences in the prefixes that don't change the result
+// for any address, like an entry removed because a shorter prefix containing
+// it has the same value. The callback gets the value from each table which is
+// only meaningful if the corresponding ok is true. Adjacent ranges with the
+// same pair of values are joined. Values from the two tables are compared
+// using the left table's comparator. It stops iteration immediately if
+// callback returns false.
+//
+// It returns false if iteration was stopped due to a callback return false or
+// true if it iterated all items.
+func EffectiveDiff(left, right TableX, callback func(rng Range, l, r interface{}, lok, rok bool) bool) bool {
+	leftEq, rightEq := left.eq, right.eq
+	if leftEq == nil {
+		leftEq = defaultComparator
+	}
+	if rightEq == nil {
+		rightEq = defaultComparator
+	}
+	same := func(a, b interface{}, aOk, bOk bool, eq comparator) bool {
+		if aOk != bOk {
+			return false
+		}
+		return !aOk || eq(a, b)
+	}
+
+	regions := overlayRegions(left, right)
+	var pending *overlayRegion
+	var pendingRange Range
+	for i, region := range regions {
+		l, lok := region.left.value()
+		r, rok := region.right.value()
+		if same(l, r, lok, rok, leftEq) {
+			continue
+		}
+
+		rng := region.Prefix.Range()
+		if pending != nil {
+			pl, plok := pending.left.value()
+			pr, prok := pending.right.value()
+			adjacent := pendingRange.last.ui+1 == rng.first.ui
+			if adjacent && same(pl, l, plok, lok, leftEq) && same(pr, r, prok, rok, rightEq) {
+				pendingRange.last = rng.last
+				continue
+			}
+			if !callback(pendingRange, pl, pr, plok, prok) {
+				return false
+			}
+		}
+		pending, pendingRange = &regions[i], rng
+	}
+	if pending != nil {
+		l, lok := pending.left.value()
+		r, rok := pending.right.value()
+		return callback(pendingRange, l, r, lok, rok)
+	}
+	return true
+}
+
+// EquivalentLookup returns true if LongestMatch returns the same thing for
+// every address in the two tables, even if the prefixes in them are different.
+// Values are compared using the left table's comparator.
+func EquivalentLookup(left, right TableX) bool {
+	return EffectiveDiff(left, right, func(Range, interface{}, interface{}, bool, bool) bool {
+		return false
+	})
+}
@@ -0,0 +1,195 @@
+package ipv4
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type overlayEntry struct {
+	prefix   string
+	l, r     interface{}
+	lok, rok bool
+}
+
+func collectOverlay(left, right TableX) []overlayEntry {
+	var result []overlayEntry
+	Overlay(left, right, func(p Prefix, l, r interface{}, lok, rok bool) bool {
+		result = append(result, overlayEntry{p.String(), l, r, lok, rok})
+		return true
+	})
+	return result
+}
+
+func TestOverlay(t *testing.T) {
+	left := NewTableX_()
+	left.Insert(_p("10.0.0.0/22"), "a")
+	left.Insert(_p("10.0.1.0/24"), "b")
+	left.Insert(_p("10.0.2.0/24"), "a")
+
+	right := NewTableX_()
+	right.Insert(_p("10.0.0.0/23"), 1)
+	right.Insert(_p("10.0.3.128/25"), 2)
+	right.Insert(_p("192.168.0.0/16"), 3)
+
+	assert.Equal(t, []overlayEntry{
+		{"10.0.0.0/24", "a", 1, true, true},
+		{"10.0.1.0/24", "b", 1, true, true},
+		{"10.0.2.0/24", "a", nil, true, false},
+		{"10.0.3.0/25", "a", nil, true, false},
+		{"10.0.3.128/25", "a", 2, true, true},
+		{"192.168.0.0/16", nil, 3, false, true},
+	}, collectOverlay(left.Table(), right.Table()))
+
+	t.Run("empty", func(t *testing.T) {
+		assert.Nil(t, collectOverlay(TableX{}, TableX{}))
+		assert.Equal(t, []overlayEntry{
+			{"10.0.0.0/23", nil, 1, false, true},
+			{"10.0.3.128/25", nil, 2, false, true},
+			{"192.168.0.0/16", nil, 3, false, true},
+		}, collectOverlay(TableX{}, right.Table()))
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		var count int
+		assert.False(t, Overlay(left.Table(), right.Table(), func(Prefix, interface{}, interface{}, bool, bool) bool {
+			count++
+			return count < 2
+		}))
+		assert.Equal(t, 2, count)
+	})
+
+	t.Run("no change", func(t *testing.T) {
+		// Nested entries with the same value don't split anything
+		nested := NewTableX_()
+		nested.Insert(_p("10.0.0.0/16"), 1)
+		nested.Insert(_p("10.0.0.0/24"), 1)
+		nested.Insert(_p("10.0.1.0/24"), 1)
+		assert.Equal(t, []overlayEntry{
+			{"10.0.0.0/16", 1, nil, true, false},
+		}, collectOverlay(nested.Table(), TableX{}))
+	})
+}
+
+func TestOverlayRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(47))
+
+	left, right := NewTableX_(), NewTableX_()
+	for _, p := range randomPrefixes(r, 300) {
+		left.InsertOrUpdate(p, r.Intn(3))
+	}
+	for _, p := range randomPrefixes(r, 300) {
+		right.InsertOrUpdate(p, r.Intn(3))
+	}
+
+	covered := NewSet_()
+	var total int64
+	var last Prefix
+	first := true
+	Overlay(left.Table(), right.Table(), func(p Prefix, l, r interface{}, lok, rok bool) bool {
+		assert.True(t, lok || rok)
+		if !first {
+			assert.True(t, last.lessThan(p))
+		}
+		last, first = p, false
+
+		covered.Insert(p)
+		total += p.NumAddresses()
+		for _, a := range []Address{p.Network().addr, p.Broadcast().addr} {
+			value, found, _ := left.LongestMatch(a)
+			assert.Equal(t, lok, found)
+			assert.Equal(t, value, l)
+			value, found, _ = right.LongestMatch(a)
+			assert.Equal(t, rok, found)
+			assert.Equal(t, value, r)
+		}
+		return true
+	})
+	// The prefixes don't overlap and cover everything matched on either side
+	assert.Equal(t, covered.NumAddresses(), total)
+	matched := NewSet_()
+	for _, table := range []TableX_{left, right} {
+		table.Table().Walk(func(p Prefix, _ interface{}) bool {
+			matched.Insert(p)
+			return true
+		})
+	}
+	assert.Equal(t, matched.NumAddresses(), total)
+}
+
+func TestEffectiveDiff(t *testing.T) {
+	original := NewTableX_()
+	original.Insert(_p("10.0.0.0/24"), 1)
+	original.Insert(_p("10.0.1.0/24"), 1)
+	original.Insert(_p("10.0.2.0/23"), 2)
+	original.Insert(_p("10.0.3.0/25"), 2)
+
+	aggregated := NewTableX_()
+	aggregated.Insert(_p("10.0.0.0/23"), 1)
+	aggregated.Insert(_p("10.0.2.0/23"), 2)
+
+	assert.False(t, original.Table().trie.Equal(aggregated.Table().trie, ieq))
+	assert.True(t, EquivalentLookup(original.Table(), aggregated.Table()))
+	assert.True(t, EquivalentLookup(aggregated.Table(), original.Table()))
+	assert.True(t, EquivalentLookup(TableX{}, TableX{}))
+	assert.True(t, EffectiveDiff(original.Table(), aggregated.Table(), func(Range, interface{}, interface{}, bool, bool) bool {
+		t.Fail()
+		return true
+	}))
+
+	changed := aggregated.Table().Build(func(t_ TableX_) bool {
+		t_.Insert(_p("10.0.0.128/25"), 3)
+		t_.Insert(_p("10.0.1.0/24"), 3)
+		t_.Remove(_p("10.0.2.0/23"))
+		t_.Insert(_p("10.0.2.0/24"), 2)
+		t_.Insert(_p("10.0.4.0/24"), 4)
+		return true
+	})
+	assert.False(t, EquivalentLookup(original.Table(), changed))
+
+	type diff struct {
+		r        string
+		l, r_    interface{}
+		lok, rok bool
+	}
+	var diffs []diff
+	EffectiveDiff(original.Table(), changed, func(r Range, left, right interface{}, lok, rok bool) bool {
+		diffs = append(diffs, diff{r.String(), left, right, lok, rok})
+		return true
+	})
+	assert.Equal(t, []diff{
+		// Adjacent ranges with the same values are joined
+		{"[10.0.0.128,10.0.1.255]", 1, 3, true, true},
+		{"[10.0.3.0,10.0.3.255]", 2, nil, true, false},
+		{"[10.0.4.0,10.0.4.255]", nil, 4, false, true},
+	}, diffs)
+
+	t.Run("stop", func(t *testing.T) {
+		var count int
+		assert.False(t, EffectiveDiff(original.Table(), changed, func(Range, interface{}, interface{}, bool, bool) bool {
+			count++
+			return false
+		}))
+		assert.Equal(t, 1, count)
+	})
+}
+
+func TestEquivalentLookupRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(48))
+
+	table := NewTableX_()
+	for _, p := range randomPrefixes(r, 1000) {
+		table.InsertOrUpdate(p, r.Intn(2))
+	}
+	assert.True(t, EquivalentLookup(table.Table(), table.Table().Disaggregate()))
+	assert.True(t, EquivalentLookup(table.Table().Disaggregate(), table.Table()))
+
+	different := table.Table().Map(func(p Prefix, value interface{}) interface{} {
+		if p.Length() == 20 {
+			return 2
+		}
+		return value
+	})
+	assert.False(t, EquivalentLookup(table.Table(), different))
+}
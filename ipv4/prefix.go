@@ -80,6 +80,23 @@ func PrefixFromString(prefix string) (Prefix, error) {
 	return PrefixFromNetIPNet(ipNet)
 }
 
+// MarshalText implements encoding.TextMarshaler using the same CIDR notation
+// as String
+func (me Prefix) MarshalText() ([]byte, error) {
+	return []byte(me.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. It accepts the same CIDR
+// notation as PrefixFromString
+func (me *Prefix) UnmarshalText(text []byte) error {
+	prefix, err := PrefixFromString(string(text))
+	if err != nil {
+		return err
+	}
+	*me = prefix
+	return nil
+}
+
 // Address returns the address part of the Prefix, including host bits
 func (me Prefix) Address() Address {
 	return me.addr
@@ -195,12 +212,7 @@ func (me Prefix) Uint32() (address, mask uint32) {
 // It returns false if iteration was stopped due to a callback return false or
 // true if it iterated all items.
 func (me Prefix) walkAddresses(callback func(Address) bool) bool {
-	for a := me.Network().addr.Uint32(); a <= me.Broadcast().addr.Uint32(); a++ {
-		if !callback(Address{a}) {
-			return false
-		}
-	}
-	return true
+	return me.Range().walkAddresses(callback)
 }
 
 // Range returns the range that includes the same addresses as the prefix
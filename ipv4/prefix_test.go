@@ -406,6 +406,34 @@ func TestPrefixString(t *testing.T) {
 	}
 }
 
+func TestPrefixText(t *testing.T) {
+	cidrs := []string{
+		"0.0.0.0/0",
+		"10.224.24.117/25",
+		"1.2.3.4/32",
+	}
+
+	for _, cidr := range cidrs {
+		t.Run(cidr, func(t *testing.T) {
+			text, err := _p(cidr).MarshalText()
+			assert.Nil(t, err)
+			assert.Equal(t, cidr, string(text))
+
+			var prefix Prefix
+			err = prefix.UnmarshalText(text)
+			assert.Nil(t, err)
+			assert.Equal(t, _p(cidr), prefix)
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		var prefix Prefix
+		err := prefix.UnmarshalText([]byte("10.224.24.1"))
+		assert.NotNil(t, err)
+		assert.Equal(t, Prefix{}, prefix)
+	})
+}
+
 func TestPrefixUint32(t *testing.T) {
 	address, mask := _p("10.224.24.1/24").Uint32()
 	assert.Equal(t, uint32(0x0ae01801), address)
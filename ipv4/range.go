@@ -2,6 +2,7 @@ package ipv4
 
 import (
 	"fmt"
+	"math/bits"
 )
 
 // Range represents a range of addresses that don't have to be aligned to
@@ -90,6 +91,50 @@ func (me Range) Plus(other Range) []Range {
 	return plus(other, me)
 }
 
+// walkAddresses visits all of the addresses in the range in lexigraphical
+// order
+//
+// It returns false if iteration was stopped due to a callback return false or
+// true if it iterated all items.
+func (me Range) walkAddresses(callback func(Address) bool) bool {
+	for a := me.first.ui; ; a++ {
+		if !callback(Address{a}) {
+			return false
+		}
+		// Checked after the callback to avoid overflowing past the last address
+		if a == me.last.ui {
+			return true
+		}
+	}
+}
+
+// walkPrefixes visits the smallest set of prefixes that exactly covers the
+// range in lexigraphical order
+//
+// It returns false if iteration was stopped due to a callback return false or
+// true if it iterated all items.
+func (me Range) walkPrefixes(callback func(Prefix) bool) bool {
+	first := me.first.ui
+	for {
+		// The largest prefix starting at first that doesn't pass the last
+		length := 32 - bits.TrailingZeros32(first)
+		if first == 0 {
+			length = 0
+		}
+		for length < 32 && first|(uint32(0xffffffff)>>length) > me.last.ui {
+			length++
+		}
+		if !callback(Prefix{Address{first}, uint32(length)}) {
+			return false
+		}
+		last := first | (uint32(0xffffffff) >> length)
+		if length == 0 || last == me.last.ui {
+			return true
+		}
+		first = last + 1
+	}
+}
+
 // Set returns a Set_ containing the same ips as this range
 func (me Range) Set() Set {
 	return Set{
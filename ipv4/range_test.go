@@ -322,6 +322,19 @@ func TestRangeSet(t *testing.T) {
 	assert.True(t, golden.Set().Equal(r.Set()))
 }
 
+func TestRangeSetUnaligned(t *testing.T) {
+	// The first and last addresses differ in every bit after the common
+	// prefix but the range isn't aligned so it isn't a single prefix.
+	r := Range{_a("10.0.1.128"), _a("10.0.2.127")}
+
+	golden := NewSet_()
+	golden.Insert(_p("10.0.1.128/25"))
+	golden.Insert(_p("10.0.2.0/25"))
+
+	assert.True(t, golden.Set().Equal(r.Set()))
+	assert.Equal(t, int64(256), r.Set().NumAddresses())
+}
+
 func TestRangePlus(t *testing.T) {
 	tests := []struct {
 		description string
@@ -398,3 +411,29 @@ func TestRangeAsMapKey(t *testing.T) {
 
 	assert.True(t, m[_r(_a("203.0.113.0"), _a("203.0.113.127"))])
 }
+
+func TestRangeWalkPrefixes(t *testing.T) {
+	tests := []Range{
+		_r(_a("0.0.0.0"), _a("255.255.255.255")),
+		_r(_a("0.0.0.0"), _a("0.0.0.0")),
+		_r(_a("255.255.255.255"), _a("255.255.255.255")),
+		_r(_a("10.0.1.3"), _a("10.0.2.9")),
+		_r(_a("0.0.0.1"), _a("255.255.255.254")),
+		_r(_a("10.0.0.0"), _a("10.0.255.255")),
+	}
+	for _, r := range tests {
+		t.Run(r.String(), func(t *testing.T) {
+			var prefixes []Prefix
+			r.walkPrefixes(func(p Prefix) bool {
+				prefixes = append(prefixes, p)
+				return true
+			})
+			var expected []Prefix
+			r.Set().WalkPrefixes(func(p Prefix) bool {
+				expected = append(expected, p)
+				return true
+			})
+			assert.Equal(t, expected, prefixes)
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package ipv4
+
+import (
+	"sort"
+	"sync"
+)
+
+// RangeTableEntry is a single range/value pair from a RangeTable
+type RangeTableEntry struct {
+	Range Range
+	Value interface{}
+}
+
+// RangeTable_ is a mutable version of RangeTable, allowing inserting or
+// replacing ranges. You can use it as a RangeTable builder or on its own.
+//
+// The zero value of a RangeTable_ is unitialized. Reading it is equivalent to
+// reading an empty RangeTable_. Attempts to modify it will result in a panic.
+// Always use NewRangeTable_() to get an initialized RangeTable_.
+//
+// A RangeTable_ is safe for concurrent use. Unlike a TableX_, whose
+// modifications are swapped in atomically, inserting into a sorted array in
+// place can't be made lock-free without copying it every time, so
+// modifications take a lock instead and are made one at a time.
+type RangeTable_ struct {
+	// All copies of a RangeTable_ share this state
+	m *mutableRangeTable
+}
+
+// mutableRangeTable is the state shared by all copies of a RangeTable_
+type mutableRangeTable struct {
+	// lock is held for writing while modifying the entries and for reading
+	// while looking at them
+	lock sync.RWMutex
+	RangeTable
+
+	// shared is set when the entries may be referenced by a RangeTable
+	// returned from RangeTable(). They are copied before being modified.
+	shared bool
+}
+
+// NewRangeTable_ returns a new fully-initialized RangeTable_
+func NewRangeTable_() RangeTable_ {
+	return RangeTable_{
+		m: &mutableRangeTable{},
+	}
+}
+
+// NumEntries returns the number of ranges in the table
+func (me RangeTable_) NumEntries() int64 {
+	if me.m == nil {
+		return 0
+	}
+	me.m.lock.RLock()
+	defer me.m.lock.RUnlock()
+	return me.m.NumEntries()
+}
+
+// Insert inserts the given range and value into the table. If it overlaps
+// any range already in the table, nothing is inserted and false is returned.
+// Inserting is fastest when ranges are inserted in order.
+func (me RangeTable_) Insert(r Range, value interface{}) (succeeded bool) {
+	if me.m == nil {
+		panic("cannot modify an unitialized RangeTable_")
+	}
+	me.m.lock.Lock()
+	defer me.m.lock.Unlock()
+	i := me.m.search(r.first)
+	if i < len(me.m.entries) && !r.last.lessThan(me.m.entries[i].Range.first) {
+		return false
+	}
+	if me.m.shared {
+		me.m.entries = append(make([]RangeTableEntry, 0, len(me.m.entries)+1), me.m.entries...)
+		me.m.shared = false
+	}
+	me.m.entries = append(me.m.entries, RangeTableEntry{})
+	copy(me.m.entries[i+1:], me.m.entries[i:])
+	me.m.entries[i] = RangeTableEntry{r, value}
+	return true
+}
+
+// InsertOrUpdate inserts the given range and value into the table, replacing
+// the values for any addresses in it that are already in the table. Ranges
+// that partly overlap it are split to keep the addresses outside of it.
+func (me RangeTable_) InsertOrUpdate(r Range, value interface{}) {
+	if me.m == nil {
+		panic("cannot modify an unitialized RangeTable_")
+	}
+	me.m.lock.Lock()
+	defer me.m.lock.Unlock()
+	i := me.m.search(r.first)
+	j := i
+	for j < len(me.m.entries) && !r.last.lessThan(me.m.entries[j].Range.first) {
+		j++
+	}
+
+	replacement := make([]RangeTableEntry, 0, 3)
+	if i < j && me.m.entries[i].Range.first.lessThan(r.first) {
+		before := me.m.entries[i]
+		before.Range.last = r.prev()
+		replacement = append(replacement, before)
+	}
+	replacement = append(replacement, RangeTableEntry{r, value})
+	if i < j && r.last.lessThan(me.m.entries[j-1].Range.last) {
+		after := me.m.entries[j-1]
+		after.Range.first = r.next()
+		replacement = append(replacement, after)
+	}
+
+	// This always makes a new array so it doesn't matter if it is shared
+	entries := make([]RangeTableEntry, 0, len(me.m.entries)-(j-i)+len(replacement))
+	entries = append(entries, me.m.entries[:i]...)
+	entries = append(entries, replacement...)
+	me.m.entries = append(entries, me.m.entries[j:]...)
+	me.m.shared = false
+}
+
+// Lookup returns the value for the range containing the given address and the
+// range itself. If there is none, found is false.
+func (me RangeTable_) Lookup(address Address) (value interface{}, found bool, matchRange Range) {
+	if me.m == nil {
+		return nil, false, Range{}
+	}
+	me.m.lock.RLock()
+	defer me.m.lock.RUnlock()
+	return me.m.Lookup(address)
+}
+
+// Walk calls RangeTable.Walk on a snapshot of the current contents so the
+// callback may modify the table.
+func (me RangeTable_) Walk(callback func(Range, interface{}) bool) bool {
+	return me.RangeTable().Walk(callback)
+}
+
+// RangeTable returns an immutable snapshot of this RangeTable_. It is cheap
+// to create but the next modification after it makes a copy of the entries.
+func (me RangeTable_) RangeTable() RangeTable {
+	if me.m == nil {
+		return RangeTable{}
+	}
+	me.m.lock.Lock()
+	defer me.m.lock.Unlock()
+	me.m.shared = true
+	return me.m.RangeTable
+}
+
+// RangeTable maps non-overlapping ranges of addresses to values. Unlike a
+// TableX, the keys can be arbitrary ranges instead of prefixes which is
+// useful for data that comes that way, like GeoIP databases or DHCP pools. It
+// is stored as an array of entries sorted by address so a lookup is a binary
+// search.
+//
+// The zero value of a RangeTable is an empty table. RangeTable is immutable.
+// For a mutable equivalent, see RangeTable_.
+type RangeTable struct {
+	entries []RangeTableEntry
+}
+
+// RangeTable_ returns a mutable table initialized with the contents of this
+// one. The entries are copied when it is first modified.
+func (me RangeTable) RangeTable_() RangeTable_ {
+	return RangeTable_{
+		m: &mutableRangeTable{
+			RangeTable: me,
+			shared:     true,
+		},
+	}
+}
+
+// NumEntries returns the number of ranges in the table
+func (me RangeTable) NumEntries() int64 {
+	return int64(len(me.entries))
+}
+
+// search returns the index of the first entry which ends at or after the
+// given address or len(me.entries) if there is none
+func (me RangeTable) search(address Address) int {
+	return sort.Search(len(me.entries), func(i int) bool {
+		return !me.entries[i].Range.last.lessThan(address)
+	})
+}
+
+// Lookup returns the value for the range containing the given address and the
+// range itself. If there is none, found is false.
+func (me RangeTable) Lookup(address Address) (value interface{}, found bool, matchRange Range) {
+	i := me.search(address)
+	if i == len(me.entries) || address.lessThan(me.entries[i].Range.first) {
+		return nil, false, Range{}
+	}
+	e := me.entries[i]
+	return e.Value, true, e.Range
+}
+
+// Walk calls `callback` for each range/value pair in lexigraphical order. It
+// stops iteration immediately if callback returns false.
+//
+// It returns false if iteration was stopped due to a callback return false or
+// true if it iterated all items.
+func (me RangeTable) Walk(callback func(Range, interface{}) bool) bool {
+	for _, e := range me.entries {
+		if !callback(e.Range, e.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// TableX returns a table where each range is broken down into the fewest
+// prefixes that cover it, each mapping to the range's value. LongestMatch on
+// it returns the same value as Lookup here for every address.
+func (me RangeTable) TableX() TableX {
+	builder := trieBuilder{}
+	for _, e := range me.entries {
+		e.Range.walkPrefixes(func(p Prefix) bool {
+			// This can't fail because the ranges are sorted and don't overlap
+			builder.add(&trieNode{Prefix: p, Data: e.Value})
+			return true
+		})
+	}
+	return TableX{
+		builder.finish(),
+		defaultComparator,
+	}
+}
+
+// RangeTable returns a range table where Lookup returns the same value as
+// LongestMatch here for every address. Adjacent ranges are joined when their
+// values are equal according to this table's comparator.
+func (me TableX) RangeTable() RangeTable {
+	eq := me.eq
+	if eq == nil {
+		eq = defaultComparator
+	}
+
+	table := RangeTable{}
+	if me.trie == nil {
+		return table
+	}
+	for _, e := range me.trie.disaggregate(me.trie.Prefix.Network(), nil, nil) {
+		r := e.Prefix.Range()
+		if n := len(table.entries); n > 0 {
+			last := &table.entries[n-1]
+			if last.Range.next() == r.first && eq(last.Value, e.Value) {
+				last.Range.last = r.last
+				continue
+			}
+		}
+		table.entries = append(table.entries, RangeTableEntry{r, e.Value})
+	}
+	return table
+}
@@ -0,0 +1,234 @@
+package ipv4
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type rangeEntry struct {
+	r     string
+	value interface{}
+}
+
+func collectRangeTable(table RangeTable) []rangeEntry {
+	var result []rangeEntry
+	table.Walk(func(r Range, value interface{}) bool {
+		result = append(result, rangeEntry{r.String(), value})
+		return true
+	})
+	return result
+}
+
+func TestRangeTableInsert(t *testing.T) {
+	table := NewRangeTable_()
+	assert.True(t, table.Insert(_r(_a("10.0.0.10"), _a("10.0.0.20")), 1))
+	assert.True(t, table.Insert(_r(_a("10.0.0.30"), _a("10.0.0.40")), 2))
+	assert.True(t, table.Insert(_r(_a("10.0.0.0"), _a("10.0.0.9")), 3))
+	assert.True(t, table.Insert(_r(_a("10.0.0.21"), _a("10.0.0.29")), 4))
+
+	// Overlaps are rejected
+	assert.False(t, table.Insert(_r(_a("10.0.0.5"), _a("10.0.0.5")), 5))
+	assert.False(t, table.Insert(_r(_a("10.0.0.40"), _a("10.0.0.50")), 5))
+	assert.False(t, table.Insert(_r(_a("9.0.0.0"), _a("11.0.0.0")), 5))
+
+	assert.Equal(t, int64(4), table.NumEntries())
+	assert.Equal(t, []rangeEntry{
+		{"[10.0.0.0,10.0.0.9]", 3},
+		{"[10.0.0.10,10.0.0.20]", 1},
+		{"[10.0.0.21,10.0.0.29]", 4},
+		{"[10.0.0.30,10.0.0.40]", 2},
+	}, collectRangeTable(table.RangeTable()))
+}
+
+func TestRangeTableInsertOrUpdate(t *testing.T) {
+	table := NewRangeTable_()
+	table.InsertOrUpdate(_r(_a("10.0.0.10"), _a("10.0.0.20")), 1)
+	table.InsertOrUpdate(_r(_a("10.0.0.30"), _a("10.0.0.40")), 2)
+	table.InsertOrUpdate(_r(_a("10.0.0.50"), _a("10.0.0.60")), 3)
+
+	// Splits the ends and replaces the middle
+	table.InsertOrUpdate(_r(_a("10.0.0.15"), _a("10.0.0.55")), 4)
+	assert.Equal(t, []rangeEntry{
+		{"[10.0.0.10,10.0.0.14]", 1},
+		{"[10.0.0.15,10.0.0.55]", 4},
+		{"[10.0.0.56,10.0.0.60]", 3},
+	}, collectRangeTable(table.RangeTable()))
+
+	// Splits a single range in two
+	table.InsertOrUpdate(_r(_a("10.0.0.20"), _a("10.0.0.20")), 5)
+	assert.Equal(t, []rangeEntry{
+		{"[10.0.0.10,10.0.0.14]", 1},
+		{"[10.0.0.15,10.0.0.19]", 4},
+		{"[10.0.0.20,10.0.0.20]", 5},
+		{"[10.0.0.21,10.0.0.55]", 4},
+		{"[10.0.0.56,10.0.0.60]", 3},
+	}, collectRangeTable(table.RangeTable()))
+
+	// Replaces everything
+	table.InsertOrUpdate(_r(_a("0.0.0.0"), _a("255.255.255.255")), 6)
+	assert.Equal(t, []rangeEntry{
+		{"[0.0.0.0,255.255.255.255]", 6},
+	}, collectRangeTable(table.RangeTable()))
+}
+
+func TestRangeTableLookup(t *testing.T) {
+	table := NewRangeTable_()
+	_, found, _ := table.Lookup(_a("10.0.0.1"))
+	assert.False(t, found)
+
+	table.Insert(_r(_a("10.0.0.10"), _a("10.0.0.20")), 1)
+	table.Insert(_r(_a("10.0.0.21"), _a("10.0.0.21")), 2)
+
+	tests := []struct {
+		address string
+		value   interface{}
+		found   bool
+		r       Range
+	}{
+		{"10.0.0.9", nil, false, Range{}},
+		{"10.0.0.10", 1, true, _r(_a("10.0.0.10"), _a("10.0.0.20"))},
+		{"10.0.0.20", 1, true, _r(_a("10.0.0.10"), _a("10.0.0.20"))},
+		{"10.0.0.21", 2, true, _r(_a("10.0.0.21"), _a("10.0.0.21"))},
+		{"10.0.0.22", nil, false, Range{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			value, found, r := table.Lookup(_a(tt.address))
+			assert.Equal(t, tt.found, found)
+			assert.Equal(t, tt.value, value)
+			assert.Equal(t, tt.r, r)
+		})
+	}
+
+	t.Run("stop", func(t *testing.T) {
+		assert.False(t, table.Walk(func(Range, interface{}) bool {
+			return false
+		}))
+	})
+}
+
+func TestRangeTableSnapshot(t *testing.T) {
+	table := NewRangeTable_()
+	table.Insert(_r(_a("10.0.0.10"), _a("10.0.0.20")), 1)
+	table.Insert(_r(_a("10.0.0.30"), _a("10.0.0.40")), 2)
+	snapshot := table.RangeTable()
+
+	// Modifying the table doesn't change the snapshot
+	table.Insert(_r(_a("10.0.0.0"), _a("10.0.0.5")), 3)
+	table.InsertOrUpdate(_r(_a("10.0.0.15"), _a("10.0.0.35")), 4)
+	expected := []rangeEntry{
+		{"[10.0.0.10,10.0.0.20]", 1},
+		{"[10.0.0.30,10.0.0.40]", 2},
+	}
+	assert.Equal(t, expected, collectRangeTable(snapshot))
+
+	// Nor does modifying a mutable copy of it
+	copied := snapshot.RangeTable_()
+	copied.Insert(_r(_a("10.0.0.21"), _a("10.0.0.29")), 5)
+	assert.Equal(t, expected, collectRangeTable(snapshot))
+	assert.Equal(t, int64(3), copied.NumEntries())
+	value, found, _ := copied.Lookup(_a("10.0.0.25"))
+	assert.True(t, found)
+	assert.Equal(t, 5, value)
+
+	// The zero value is empty and can't be modified
+	assert.Equal(t, int64(0), RangeTable_{}.NumEntries())
+	assert.True(t, RangeTable_{}.Walk(func(Range, interface{}) bool { return false }))
+	assert.Panics(t, func() {
+		RangeTable_{}.Insert(_r(_a("10.0.0.0"), _a("10.0.0.5")), 1)
+	})
+}
+
+func TestRangeTableConcurrent(t *testing.T) {
+	table := NewRangeTable_()
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 256; i++ {
+				a := AddressFromBytes(10, byte(g), byte(i), 0)
+				table.Insert(_r(a, Address{a.ui + 255}), g)
+				table.Lookup(a)
+				if i%64 == 0 {
+					table.RangeTable()
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// Nothing was lost
+	assert.Equal(t, int64(1024), table.NumEntries())
+	var previous *Range
+	table.Walk(func(r Range, _ interface{}) bool {
+		if previous != nil {
+			assert.True(t, previous.last.lessThan(r.first))
+		}
+		previous = &r
+		return true
+	})
+}
+
+func TestRangeTableTableX(t *testing.T) {
+	table := NewRangeTable_()
+	table.Insert(_r(_a("10.0.0.1"), _a("10.0.0.6")), 1)
+	table.Insert(_r(_a("10.0.0.7"), _a("10.0.0.8")), 2)
+
+	var result []pair
+	table.RangeTable().TableX().Walk(func(p Prefix, value interface{}) bool {
+		result = append(result, pair{p.String(), value})
+		return true
+	})
+	assert.Equal(t, []pair{
+		{"10.0.0.1/32", 1},
+		{"10.0.0.2/31", 1},
+		{"10.0.0.4/31", 1},
+		{"10.0.0.6/32", 1},
+		{"10.0.0.7/32", 2},
+		{"10.0.0.8/32", 2},
+	}, result)
+
+	// Converting back joins the prefixes into the original ranges
+	assert.Equal(t, collectRangeTable(table.RangeTable()), collectRangeTable(table.RangeTable().TableX().RangeTable()))
+	assert.Equal(t, int64(0), TableX{}.RangeTable().NumEntries())
+}
+
+func TestRangeTableRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(50))
+
+	m := NewTableX_()
+	for _, p := range randomPrefixes(r, 1000) {
+		m.InsertOrUpdate(p, r.Intn(3))
+	}
+	table := m.Table()
+
+	ranges := table.RangeTable()
+	require.NotZero(t, ranges.NumEntries())
+	assert.True(t, EquivalentLookup(table, ranges.TableX()))
+
+	var previous *RangeTableEntry
+	ranges.Walk(func(rng Range, value interface{}) bool {
+		if previous != nil {
+			// Sorted, not overlapping, and adjacent ranges have different values
+			assert.True(t, previous.Range.last.lessThan(rng.first))
+			if previous.Range.next() == rng.first {
+				assert.NotEqual(t, previous.Value, value)
+			}
+		}
+		previous = &RangeTableEntry{rng, value}
+
+		for _, a := range []Address{rng.first, rng.last} {
+			expected, _, _ := table.LongestMatch(a)
+			actual, found, matchRange := ranges.Lookup(a)
+			assert.True(t, found)
+			assert.Equal(t, expected, actual)
+			assert.Equal(t, rng, matchRange)
+		}
+		return true
+	})
+}
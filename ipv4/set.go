@@ -2,6 +2,7 @@ package ipv4
 
 import (
 	"strings"
+	"sync"
 )
 
 // Set_ is the mutable version of a Set, allowing insertion and deletion of
@@ -9,15 +10,31 @@ import (
 // The zero value of a Set_ is unitialized. Reading it is equivalent to reading
 // an empty set. Attempts to modify it will result in a panic. Always use
 // NewSet_() to get an initialized Set_.
+//
+// Like TableX_, a Set_ does not support concurrent modification unless it is
+// in optimistic mode. See Optimistic.
 type Set_ struct {
-	// See the note on Table_
-	s *Set
+	// See the note on TableX_
+	s *mutableSet
+
+	// See the note on TableX_
+	optimistic bool
+}
+
+// mutableSet is the state shared by all copies of a Set_
+type mutableSet struct {
+	Set
+	subscribers subscribers
+
+	// See the note on mutableTableX
+	lock    sync.RWMutex
+	journal *SetJournal
 }
 
 // NewSet_ returns a new fully-initialized Set_
 func NewSet_() Set_ {
 	return Set_{
-		s: &Set{},
+		s: &mutableSet{},
 	}
 }
 
@@ -28,23 +45,66 @@ func (me Set_) Set() Set {
 		return Set{}
 	}
 	return Set{
-		trie: me.s.trie,
+		trie: me.root(),
 	}
 }
 
-// mutate should be called by any method that modifies the set in any way
-func (me Set_) mutate(mutator func() (ok bool, newNode *setNode)) {
-	oldNode := me.s.trie
-	ok, newNode := mutator()
-	if ok && oldNode != newNode {
-		if !swapSetNodePtr(&me.s.trie, oldNode, newNode) {
+// Optimistic returns a Set_ that refers to the same set as this one but
+// supports lock-free concurrent modification from multiple goroutines. Each
+// modification made through it is retried against the new contents of the set
+// until it succeeds instead of panicking when a concurrent modification is
+// detected.
+func (me Set_) Optimistic() Set_ {
+	me.optimistic = true
+	return me
+}
+
+// root atomically loads the root of the trie
+func (me Set_) root() *setNode {
+	return loadSetNodePtr(&me.s.trie)
+}
+
+// mutate should be called by any method that modifies the set in any way. The
+// mutator must compute the new root from the result of calling root(). In
+// optimistic mode, it may be called more than once. It returns an error,
+// leaving the set unmodified, if the modification can't be journaled.
+func (me Set_) mutate(mutator func() (ok bool, newNode *setNode)) error {
+	for {
+		oldNode := me.root()
+		ok, newNode := mutator()
+		if !ok || oldNode == newNode {
+			return nil
+		}
+		swapped, err := me.s.swap(oldNode, newNode)
+		if err != nil {
+			return err
+		}
+		if swapped {
+			me.s.subscribers.notify()
+			return nil
+		}
+		if !me.optimistic {
 			panic("concurrent modification of Set_ detected")
 		}
 	}
 }
 
+// swap atomically replaces the root of the trie if it is still oldNode,
+// writing the change to the journal first if there is one
+func (me *mutableSet) swap(oldNode, newNode *setNode) (bool, error) {
+	me.lock.RLock()
+	defer me.lock.RUnlock()
+	if me.journal != nil {
+		return me.journal.commit(oldNode, newNode)
+	}
+	return swapSetNodePtr(&me.trie, oldNode, newNode), nil
+}
+
 // Insert inserts all IPs from the given set into this one. It is
 // effectively a Union with the other set in place.
+//
+// If the set is journaled and the change can't be recorded, the set is left
+// unmodified; check SetJournal.Err to find out.
 func (me Set_) Insert(other SetI) {
 	if me.s == nil {
 		panic("cannot modify an unitialized Set_")
@@ -53,13 +113,16 @@ func (me Set_) Insert(other SetI) {
 		other = Set{}
 	}
 	me.mutate(func() (bool, *setNode) {
-		return true, me.s.trie.Union(other.Set().trie)
+		return true, me.root().Union(other.Set().trie)
 	})
 }
 
 // Remove removes the given set (all of its addreses) from the set. It ignores
 // any addresses in the other set which were not already in the set. It is
 // effectively a Difference with the other set in place.
+//
+// If the set is journaled and the change can't be recorded, the set is left
+// unmodified; check SetJournal.Err to find out.
 func (me Set_) Remove(other SetI) {
 	if me.s == nil {
 		panic("cannot modify an unitialized Set_")
@@ -68,7 +131,7 @@ func (me Set_) Remove(other SetI) {
 		other = Set{}
 	}
 	me.mutate(func() (bool, *setNode) {
-		return true, me.s.trie.Difference(other.Set().trie)
+		return true, me.root().Difference(other.Set().trie)
 	})
 }
 
@@ -77,7 +140,7 @@ func (me Set_) NumAddresses() int64 {
 	if me.s == nil {
 		return 0
 	}
-	return me.s.NumAddresses()
+	return me.Set().NumAddresses()
 }
 
 // Contains tests if the given prefix is entirely contained in the set
@@ -85,7 +148,7 @@ func (me Set_) Contains(other SetI) bool {
 	if me.s == nil {
 		return other == nil || other.Set().NumAddresses() == 0
 	}
-	return me.s.Contains(other)
+	return me.Set().Contains(other)
 }
 
 // Equal returns true if this set is equal to other
@@ -93,11 +156,11 @@ func (me Set_) Equal(other Set_) bool {
 	if me.s == nil {
 		return other.NumAddresses() == 0
 	}
-	return me.s.Equal(other.Set())
+	return me.Set().Equal(other.Set())
 }
 
 func (me Set_) isValid() bool {
-	return me.s.isValid()
+	return me.Set().isValid()
 }
 
 // Union returns a new fixed set with all addresses from both sets
@@ -108,7 +171,7 @@ func (me Set_) Union(other SetI) Set {
 	if me.s == nil {
 		return other.Set()
 	}
-	return me.s.Union(other)
+	return me.Set().Union(other)
 }
 
 // Intersection returns a new fixed set with all addresses that appear in both sets
@@ -119,7 +182,7 @@ func (me Set_) Intersection(other SetI) Set {
 	if me.s == nil {
 		return Set{}
 	}
-	return me.s.Intersection(other)
+	return me.Set().Intersection(other)
 }
 
 // Difference returns a new fixed set with all addresses that appear in this set
@@ -131,7 +194,7 @@ func (me Set_) Difference(other SetI) Set {
 	if me.s == nil {
 		return Set{}
 	}
-	return me.s.Difference(other)
+	return me.Set().Difference(other)
 }
 
 // Set is a structure that efficiently stores sets of addresses and supports
@@ -160,8 +223,8 @@ var _ SetI = Set{}
 // Set_ returns a Set_ initialized with the contents of the fixed set
 func (me Set) Set_() Set_ {
 	return Set_{
-		s: &Set{
-			trie: me.trie,
+		s: &mutableSet{
+			Set: me,
 		},
 	}
 }
@@ -191,6 +254,35 @@ func (me Set) NumAddresses() int64 {
 	return me.trie.NumAddresses()
 }
 
+// Nth returns the address at the given index in lexigraphical order, the
+// same order as WalkAddresses. If the index is out of range, found is false.
+// It takes time proportional to the height of the underlying structure, not
+// the number of addresses, so it is useful for paging through a set or
+// deterministically picking an address from it.
+func (me Set) Nth(index int64) (address Address, found bool) {
+	if index < 0 || index >= me.NumAddresses() {
+		return Address{}, false
+	}
+	return me.trie.NthAddress(index), true
+}
+
+// Rank returns the number of addresses in the set that come before the given
+// address in lexigraphical order. The address doesn't need to be in the set.
+// If it is, Nth(Rank(address)) returns it.
+func (me Set) Rank(address Address) int64 {
+	return me.trie.RankAddress(address)
+}
+
+// NthPrefix returns the prefix at the given index in the order visited by
+// WalkPrefixes. If the index is out of range, found is false.
+func (me Set) NthPrefix(index int64) (prefix Prefix, found bool) {
+	node := me.trie.Nth(index)
+	if node == nil {
+		return Prefix{}, false
+	}
+	return node.Prefix, true
+}
+
 // WalkPrefixes calls `callback` for each prefix stored in lexographical
 // order. It stops iteration immediately if callback returns false. It always
 // uses the largest prefixes possible so if two prefixes are adjacent and can
@@ -199,9 +291,13 @@ func (me Set) NumAddresses() int64 {
 // It returns false if iteration was stopped due to a callback return false or
 // true if it iterated all items.
 func (me Set) WalkPrefixes(callback func(Prefix) bool) bool {
-	return me.trie.Walk(func(prefix Prefix, data interface{}) bool {
-		return callback(prefix)
-	})
+	return me.trie.Walk(callback)
+}
+
+// WalkPrefixesReverse is like WalkPrefixes but visits the prefixes in reverse
+// lexigraphical order.
+func (me Set) WalkPrefixesReverse(callback func(Prefix) bool) bool {
+	return me.trie.WalkReverse(callback)
 }
 
 // String returns a string representation of the set showing the minimal set of
@@ -266,6 +362,35 @@ func (me Set) WalkRanges(callback func(Range) bool) bool {
 	return true
 }
 
+// WalkRangesReverse is like WalkRanges but visits the ranges in reverse
+// lexigraphical order.
+func (me Set) WalkRangesReverse(callback func(Range) bool) bool {
+	ranges := []Range{}
+	finished := me.WalkPrefixesReverse(func(p Prefix) bool {
+		if len(ranges) != 0 {
+			ranges = p.Range().Plus(ranges[0])
+		} else {
+			ranges = []Range{p.Range()}
+		}
+		if len(ranges) == 2 {
+			if !callback(ranges[1]) {
+				return false
+			}
+			ranges = ranges[:1]
+		}
+		return true
+	})
+	if !finished {
+		return false
+	}
+	if len(ranges) == 1 {
+		if !callback(ranges[0]) {
+			return false
+		}
+	}
+	return true
+}
+
 // Equal returns true if this set is equal to other
 func (me Set) Equal(other Set) bool {
 	return me.trie.Equal(other.trie)
@@ -113,6 +113,25 @@ func TestSetConcurrentModification(t *testing.T) {
 	assert.Equal(t, 1, panicked)
 }
 
+func TestSetOptimisticConcurrentModification(t *testing.T) {
+	set := NewSet_().Optimistic()
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 64; j++ {
+				set.Insert(AddressFromBytes(10, byte(i), byte(j), 0))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(8*64), set.NumAddresses())
+	assert.True(t, set.isValid())
+}
+
 func TestNilSet(t *testing.T) {
 	var set Set_
 
@@ -860,3 +879,111 @@ func TestOldEqualAllIPv4(t *testing.T) {
 	assert.True(t, c.Equal(a))
 	assert.True(t, c.Equal(b))
 }
+
+func TestSetNumAddressesCached(t *testing.T) {
+	s := NewSet_()
+	assert.Equal(t, int64(0), s.NumAddresses())
+
+	s.Insert(Prefix{})
+	assert.Equal(t, int64(1)<<32, s.NumAddresses())
+
+	s.Remove(_p("10.0.0.0/8"))
+	s.Remove(_r(_a("192.168.0.7"), _a("192.168.3.200")))
+	s.Remove(_a("203.0.113.1"))
+	assert.True(t, s.isValid())
+
+	var count int64
+	s.Set().WalkPrefixes(func(p Prefix) bool {
+		count += p.NumAddresses()
+		return true
+	})
+	assert.Equal(t, count, s.NumAddresses())
+	assert.Equal(t, int64(1)<<32-1<<24-(0x03c8-0x0007+1)-1, s.NumAddresses())
+}
+
+func TestSetNthRank(t *testing.T) {
+	set := _p("10.0.0.0/30").Set().
+		Union(_r(_a("10.0.1.3"), _a("10.0.1.9"))).
+		Union(_a("192.168.0.1"))
+
+	var addresses []Address
+	set.WalkAddresses(func(a Address) bool {
+		addresses = append(addresses, a)
+		return true
+	})
+	assert.Equal(t, int64(len(addresses)), set.NumAddresses())
+	for i, a := range addresses {
+		nth, found := set.Nth(int64(i))
+		assert.True(t, found)
+		assert.Equal(t, a, nth)
+		assert.Equal(t, int64(i), set.Rank(a))
+	}
+
+	_, found := set.Nth(-1)
+	assert.False(t, found)
+	_, found = set.Nth(set.NumAddresses())
+	assert.False(t, found)
+
+	// Addresses not in the set
+	assert.Equal(t, int64(0), set.Rank(_a("0.0.0.0")))
+	assert.Equal(t, int64(4), set.Rank(_a("10.0.0.200")))
+	assert.Equal(t, int64(4), set.Rank(_a("10.0.1.3")))
+	assert.Equal(t, int64(11), set.Rank(_a("10.0.1.10")))
+	assert.Equal(t, int64(12), set.Rank(_a("255.255.255.255")))
+	assert.Equal(t, int64(0), Set{}.Rank(_a("10.0.0.0")))
+
+	all := Prefix{}.Set()
+	nth, found := all.Nth(1<<32 - 1)
+	assert.True(t, found)
+	assert.Equal(t, _a("255.255.255.255"), nth)
+	assert.Equal(t, int64(1<<32-1), all.Rank(_a("255.255.255.255")))
+
+	var prefixes []Prefix
+	set.WalkPrefixes(func(p Prefix) bool {
+		prefixes = append(prefixes, p)
+		return true
+	})
+	for i, p := range prefixes {
+		nth, found := set.NthPrefix(int64(i))
+		assert.True(t, found)
+		assert.Equal(t, p, nth)
+	}
+	_, found = set.NthPrefix(int64(len(prefixes)))
+	assert.False(t, found)
+}
+
+func TestSetWalkReverse(t *testing.T) {
+	set := _p("10.0.0.0/24").Set().
+		Union(_r(_a("10.0.1.3"), _a("10.0.1.9"))).
+		Union(_p("10.0.1.16/28")).
+		Union(_p("10.0.1.32/28"))
+
+	var forward, reverse []Prefix
+	set.WalkPrefixes(func(p Prefix) bool {
+		forward = append([]Prefix{p}, forward...)
+		return true
+	})
+	set.WalkPrefixesReverse(func(p Prefix) bool {
+		reverse = append(reverse, p)
+		return true
+	})
+	assert.Equal(t, forward, reverse)
+
+	var ranges []Range
+	assert.True(t, set.WalkRangesReverse(func(r Range) bool {
+		ranges = append(ranges, r)
+		return true
+	}))
+	assert.Equal(t, []Range{
+		_r(_a("10.0.1.16"), _a("10.0.1.47")),
+		_r(_a("10.0.1.3"), _a("10.0.1.9")),
+		_r(_a("10.0.0.0"), _a("10.0.0.255")),
+	}, ranges)
+
+	ranges = nil
+	assert.False(t, set.WalkRangesReverse(func(r Range) bool {
+		ranges = append(ranges, r)
+		return false
+	}))
+	assert.Len(t, ranges, 1)
+}
@@ -2,21 +2,51 @@ package ipv4
 
 import (
 	"math/bits"
+	"unsafe"
 )
 
-// setNode is currently the same data structure as trieNode. However,
-// its purpose is to implement a set of keys. Hence, values in the underlying
-// data structure are completely ignored. Aliasing it in this way allows me to
-// provide a completely different API on top of the same data structure and
-// benefit from the trieNode API where needed by casting.
-type setNode trieNode
+// setNode implements a set of keys with a structure like trieNode's but
+// without anything that a set doesn't need, like a value. The trie is always
+// kept flat: only leaves are active and no two prefixes overlap or could be
+// combined into a larger one. Every Set with the same addresses has the same
+// structure.
+//
+// Where a /24 contains many small prefixes, they are replaced by a single
+// bitmap leaf for the /24 (see bitmapMinPrefixes). A bitmap leaf isn't active
+// and has no children but counts all of the prefixes that it replaces.
+type setNode struct {
+	Prefix       Prefix
+	numAddresses uint64
+	size         uint32
+	h            uint16
+	isActive     bool
+	isBitmap     bool
+	children     [2]*setNode
+}
+
+// bitmapNode is a bitmap leaf. Only the embedded setNode, which has isBitmap
+// set, is ever referred to so that other nodes don't pay for the bitmap.
+type bitmapNode struct {
+	setNode
+	bits bitmap
+}
+
+// bitmap returns the bitmap of a bitmap leaf. It must not be called on any
+// other node.
+func (me *setNode) bitmap() *bitmap {
+	if !me.isBitmap {
+		panic("not a bitmap leaf")
+	}
+	return &(*bitmapNode)(unsafe.Pointer(me)).bits
+}
 
 func setNodeFromPrefix(p Prefix) *setNode {
 	return &setNode{
-		isActive: true,
-		Prefix:   p,
-		size:     1,
-		h:        1,
+		isActive:     true,
+		Prefix:       p,
+		size:         1,
+		h:            1,
+		numAddresses: uint64(p.NumAddresses()),
 	}
 }
 
@@ -26,7 +56,10 @@ func setNodeFromRange(r Range) *setNode {
 	// The number of leading zeroes in the xor is the number of bits the two addresses have in common
 	numCommonBits := bits.LeadingZeros32(xor)
 
-	if numCommonBits == bits.OnesCount32(^xor) {
+	// The range is exactly one prefix only if first and last differ in every
+	// host bit and first is aligned to the start of the prefix.
+	hostMask := ^(uint32(0xffffffff) << (32 - numCommonBits))
+	if numCommonBits == bits.OnesCount32(^xor) && r.first.ui&hostMask == 0 {
 		// This range is exactly one prefix, return a node with it.
 		prefix := Prefix{r.first, uint32(numCommonBits)}
 		return setNodeFromPrefix(prefix)
@@ -45,43 +78,82 @@ func setNodeFromRange(r Range) *setNode {
 	return a.Union(b)
 }
 
-// Insert inserts the key / value if the key didn't previously exist and then
-// flattens the structure (without regard to any values) to remove nested
-// prefixes resulting in a flat list of disjoint prefixes.
+// Insert adds all of the addresses in the key to the set and returns the new
+// root of the trie. It is important to note that the root of the trie can
+// change.
 func (me *setNode) Insert(key Prefix) *setNode {
-	newHead, _ := (*trieNode)(me).insert(&trieNode{Prefix: key, Data: nil}, insertOpts{insert: true, update: true, flatten: true})
-	return (*setNode)(newHead)
+	return me.Union(setNodeFromPrefix(key))
 }
 
-// Delete removes a prefix from the trie and returns the new root of the trie.
-// It is important to note that the root of the trie can change. Like Insert,
-// this is designed for using trie as a set of keys, completely ignoring
-// values. All stored prefixes that match the given prefix with LPM will be
-// removed, not just exact matches.
+// Remove removes all of the addresses in the key from the set and returns the
+// new root of the trie. Any prefix which only partially overlaps the key is
+// split to remove the overlap.
 func (me *setNode) Remove(key Prefix) *setNode {
-	newHead, _ := (*trieNode)(me).del(key, deleteOpts{flatten: true})
-	return (*setNode)(newHead)
+	return me.Difference(setNodeFromPrefix(key))
 }
 
 func (me *setNode) Left() *setNode {
-	return (*setNode)(me.children[0])
+	return me.children[0]
 }
 
 func (me *setNode) Right() *setNode {
-	return (*setNode)(me.children[1])
+	return me.children[1]
 }
 
-// so much casting!
+// mutate calls the mutator on a new node and then updates the node's counts
+// and replaces it with a bitmap leaf if it should be one.
 func (me *setNode) mutate(mutator func(*setNode)) *setNode {
-	n := (*trieNode)(me)
-	n = n.mutate(func(node *trieNode) {
-		mutator((*setNode)(node))
-	})
-	return (*setNode)(n)
+	if me == nil {
+		return nil
+	}
+
+	mutator(me)
+	me.update()
+	return me.compress()
 }
 
+// update updates the counts in the node from its children
+func (me *setNode) update() {
+	me.size = uint32(me.children[0].NumNodes() + me.children[1].NumNodes())
+	me.h = uint16(1 + intMax(me.children[0].height(), me.children[1].height()))
+	if me.isActive {
+		me.size++
+		me.numAddresses = uint64(me.Prefix.NumAddresses())
+	} else {
+		me.numAddresses = uint64(me.children[0].NumAddresses() + me.children[1].NumAddresses())
+	}
+}
+
+// flatten assumes that `me` is a new node. It should not be called that had
+// already existed as a node in the trie because it does not make a copy.
 func (me *setNode) flatten() {
-	(*trieNode)(me).flatten()
+	if me.isActive {
+		// If the current node is active, then anything referenced by the
+		// children is redundant, they can be removed.
+		me.children = [2]*setNode{}
+		return
+	}
+	left, right := me.children[0], me.children[1]
+	if left == nil || right == nil {
+		panic("this should never happen; it means that the structure is not optimized")
+	}
+	if left.Prefix.length != right.Prefix.length {
+		// If the childen have different size prefixes, then we cannot combine
+		// them. Do nothing.
+		return
+	}
+	if left.Prefix.length != me.Prefix.length+1 {
+		// If the children aren't exactly half the current node's prefix then
+		// we cannot combine them. Do nothing.
+		return
+	}
+	if !left.isActive || !right.isActive {
+		// If the children aren't both active, it means they are sparse and
+		// cannot be combined. Do nothing.
+		return
+	}
+	me.children = [2]*setNode{}
+	me.isActive = true
 }
 
 // Union returns the flattened union of prefixes.
@@ -95,6 +167,9 @@ func (me *setNode) Union(other *setNode) (rc *setNode) {
 	if me == nil {
 		return other
 	}
+	if base, ok := sameBlock(me, other); ok {
+		return combineBitmaps(base, me, other, (*bitmap).or)
+	}
 	// Test containership both ways
 	result, reversed, common, child := compare(me.Prefix, other.Prefix)
 	switch result {
@@ -117,9 +192,9 @@ func (me *setNode) Union(other *setNode) (rc *setNode) {
 				},
 				length: me.Prefix.length,
 			},
-			children: [2]*trieNode{
-				(*trieNode)(left),
-				(*trieNode)(right),
+			children: [2]*setNode{
+				left,
+				right,
 			},
 		}
 		return newHead.mutate(func(n *setNode) {
@@ -149,9 +224,9 @@ func (me *setNode) Union(other *setNode) (rc *setNode) {
 				},
 				length: super.Prefix.length,
 			},
-			children: [2]*trieNode{
-				(*trieNode)(left),
-				(*trieNode)(right),
+			children: [2]*setNode{
+				left,
+				right,
 			},
 		}
 		return newHead.mutate(func(n *setNode) {
@@ -174,9 +249,9 @@ func (me *setNode) Union(other *setNode) (rc *setNode) {
 				},
 				length: common,
 			},
-			children: [2]*trieNode{
-				(*trieNode)(left),
-				(*trieNode)(right),
+			children: [2]*setNode{
+				left,
+				right,
 			},
 		}
 		return newHead.mutate(func(n *setNode) {
@@ -185,12 +260,112 @@ func (me *setNode) Union(other *setNode) (rc *setNode) {
 	}
 }
 
+// Match returns the active node containing the given key or nil if there
+// isn't one. Since the trie is flat, there is never more than one. If a
+// bitmap leaf has all of the key's addresses, it is returned instead.
 func (me *setNode) Match(searchKey Prefix) *setNode {
-	return (*setNode)((*trieNode)(me).Match(searchKey))
+	for node := me; node != nil; {
+		if searchKey.length < node.Prefix.length {
+			return nil
+		}
+		matches, exact, _, child := contains(node.Prefix, searchKey)
+		if !matches {
+			return nil
+		}
+		if node.isActive {
+			return node
+		}
+		if node.isBitmap {
+			first := searchKey.Network().addr.ui & 0xff
+			if node.bitmap().testRange(first, first+uint32(searchKey.NumAddresses())-1) {
+				return node
+			}
+			return nil
+		}
+		if exact {
+			return nil
+		}
+		node = node.children[child]
+	}
+	return nil
 }
 
+// overlaps returns true if the set has any addresses in the given prefix. It
+// doesn't allocate anything.
+func (me *setNode) overlaps(p Prefix) bool {
+	for node := me; node != nil; {
+		result, _, _, child := compare(node.Prefix, p)
+		switch result {
+		case compareDisjoint:
+			return false
+		case compareSame, compareIsContained:
+			// Every node in a set has addresses
+			return true
+		}
+		if node.isActive {
+			return true
+		}
+		if node.isBitmap {
+			first := p.Network().addr.ui & 0xff
+			return node.bitmap().testAny(first, first+uint32(p.NumAddresses())-1)
+		}
+		node = node.children[child]
+	}
+	return false
+}
+
+// isValid returns true if the tree is valid
+// this method is only for unit tests to check the integrity of the structure
 func (me *setNode) isValid() bool {
-	return (*trieNode)(me).isValid()
+	return me.isValidLen(0)
+}
+
+func (me *setNode) isValidLen(minLen uint32) bool {
+	if me == nil {
+		return true
+	}
+	left, right := me.children[0], me.children[1]
+	if me.isBitmap {
+		return !me.isActive &&
+			left == nil && right == nil &&
+			me.Prefix.length == 24 && me.Prefix.length >= minLen &&
+			me.Prefix.addr.ui&0xff == 0 &&
+			me.size > bitmapMinPrefixes &&
+			int64(me.size) == me.bitmap().numPrefixes() &&
+			me.numAddresses == uint64(me.bitmap().count()) &&
+			me.h == 1
+	}
+	if me.isActive {
+		if left != nil || right != nil {
+			// Anything under an active node is redundant
+			return false
+		}
+		if me.size != 1 || me.numAddresses != uint64(me.Prefix.NumAddresses()) {
+			return false
+		}
+	} else {
+		if left == nil || right == nil {
+			// Any child node should have been pulled up since this node isn't active
+			return false
+		}
+		if me.size != uint32(left.NumNodes()+right.NumNodes()) {
+			return false
+		}
+		if me.numAddresses != uint64(left.NumAddresses()+right.NumAddresses()) {
+			return false
+		}
+		if me.Prefix.length >= 24 && me.size > bitmapMinPrefixes {
+			// This should have been replaced with a bitmap leaf
+			return false
+		}
+	}
+	if me.h != 1+uint16(intMax(left.height(), right.height())) {
+		return false
+	}
+	if me.Prefix.length < minLen {
+		return false
+	}
+	return left.isValidLen(me.Prefix.length+1) && right.isValidLen(me.Prefix.length+1)
 }
 
 // Difference returns the flattened difference of prefixes.
@@ -198,6 +373,9 @@ func (me *setNode) Difference(other *setNode) (rc *setNode) {
 	if me == nil || other == nil {
 		return me
 	}
+	if base, ok := sameBlock(me, other); ok {
+		return combineBitmaps(base, me, other, (*bitmap).andNot)
+	}
 
 	result, _, _, child := compare(me.Prefix, other.Prefix)
 	switch result {
@@ -256,11 +434,21 @@ func (me *setNode) Intersect(other *setNode) *setNode {
 	if result == compareDisjoint {
 		return nil
 	}
+	if base, ok := sameBlock(me, other); ok {
+		return combineBitmaps(base, me, other, (*bitmap).and)
+	}
+	if me.isBitmap {
+		// The other is shorter and contains it. Never descend into a bitmap.
+		me, other = other, me
+	}
 	if !me.isActive {
 		return other.Intersect(me.Left()).Union(
 			other.Intersect(me.Right()),
 		)
 	}
+	if other.isBitmap {
+		return other
+	}
 	if !other.isActive {
 		return me.Intersect(other.Left()).Union(
 			me.Intersect(other.Right()),
@@ -273,30 +461,159 @@ func (me *setNode) Intersect(other *setNode) *setNode {
 	return other
 }
 
+// Equal returns true if the two sets contain the same addresses. Since sets
+// are always flat, this is the case only if they have the same structure.
 func (me *setNode) Equal(other *setNode) bool {
-	return (*trieNode)(me).Equal((*trieNode)(other), func(a, b interface{}) bool {
+	switch {
+	case me == other:
 		return true
-	})
+	case me == nil, other == nil:
+		return false
+	case me.isActive != other.isActive:
+		return false
+	case me.Prefix != other.Prefix:
+		return false
+	case me.isBitmap != other.isBitmap:
+		return false
+	case me.isBitmap:
+		return *me.bitmap() == *other.bitmap()
+	}
+	return me.children[0].Equal(other.children[0]) && me.children[1].Equal(other.children[1])
 }
 
-// NumAddresses calls trieNode NumAddresses
+// NumAddresses returns the number of addresses in the set. It takes constant
+// time because the count is stored in each node.
 func (me *setNode) NumAddresses() int64 {
-	return (*trieNode)(me).NumAddresses()
+	if me == nil {
+		return 0
+	}
+	return int64(me.numAddresses)
 }
 
-// NumNodes returns the number of entries in the trie
+// NumNodes returns the number of prefixes in the set
 func (me *setNode) NumNodes() int64 {
-	return (*trieNode)(me).NumNodes()
+	if me == nil {
+		return 0
+	}
+	return int64(me.size)
 }
 
+// height returns the maximum height of the trie.
 func (me *setNode) height() int {
-	return (*trieNode)(me).height()
+	if me == nil {
+		return 0
+	}
+	return int(me.h)
+}
+
+// Walk calls the given function for each prefix in the set in lexigraphical
+// order. It returns false if iteration was stopped due to a callback return
+// false or true if it iterated all items.
+func (me *setNode) Walk(callback func(Prefix) bool) bool {
+	if me == nil {
+		return true
+	}
+	if me.isActive {
+		return callback(me.Prefix)
+	}
+	if me.isBitmap {
+		return me.bitmap().walkPrefixes(me.Prefix.addr.ui, callback)
+	}
+	return me.children[0].Walk(callback) && me.children[1].Walk(callback)
+}
+
+// WalkReverse is like Walk but visits the prefixes in exactly the opposite
+// order.
+func (me *setNode) WalkReverse(callback func(Prefix) bool) bool {
+	if me == nil {
+		return true
+	}
+	if me.isActive {
+		return callback(me.Prefix)
+	}
+	if me.isBitmap {
+		return me.bitmap().walkPrefixesReverse(me.Prefix.addr.ui, callback)
+	}
+	return me.children[1].WalkReverse(callback) && me.children[0].WalkReverse(callback)
+}
+
+// Nth returns the prefix at the given index in the order that Walk visits
+// them or nil if the index is out of range.
+func (me *setNode) Nth(index int64) *setNode {
+	if me == nil || index < 0 || index >= me.NumNodes() {
+		return nil
+	}
+	if me.isActive {
+		return me
+	}
+	if me.isBitmap {
+		return setNodeFromPrefix(me.bitmap().nthPrefix(me.Prefix.addr.ui, index))
+	}
+	if left := me.children[0].NumNodes(); index >= left {
+		return me.children[1].Nth(index - left)
+	}
+	return me.children[0].Nth(index)
+}
+
+// Rank returns the number of prefixes that Walk visits before the first one
+// that doesn't come before the given key in lexigraphical order.
+func (me *setNode) Rank(key Prefix) int64 {
+	if me == nil {
+		return 0
+	}
+	result, _, _, child := compare(me.Prefix, key)
+	switch result {
+	case compareContains:
+		if me.isActive {
+			return 1
+		}
+		if me.isBitmap {
+			return me.bitmap().rankPrefix(me.Prefix.addr.ui, key)
+		}
+		if child == 1 {
+			return me.children[0].NumNodes() + me.children[1].Rank(key)
+		}
+		return me.children[0].Rank(key)
+
+	case compareDisjoint:
+		if me.Prefix.Network().addr.lessThan(key.Network().addr) {
+			return me.NumNodes()
+		}
+	}
+	return 0
 }
 
-func (me *setNode) active() bool {
-	return (*trieNode)(me).active()
+// NthAddress returns the address at the given index in lexigraphical order.
+// The index must be less than the number of addresses in the set. It takes
+// time proportional to the height of the trie.
+func (me *setNode) NthAddress(index int64) Address {
+	if me.isActive {
+		return Address{me.Prefix.Network().addr.ui + uint32(index)}
+	}
+	if me.isBitmap {
+		return Address{me.Prefix.addr.ui + me.bitmap().nth(index)}
+	}
+	if left := me.Left().NumAddresses(); index >= left {
+		return me.Right().NthAddress(index - left)
+	}
+	return me.Left().NthAddress(index)
 }
 
-func (me *setNode) Walk(callback func(Prefix, interface{}) bool) bool {
-	return (*trieNode)(me).Walk(callback)
+// RankAddress returns the number of addresses in the set that are less than
+// the given one. It takes time proportional to the height of the trie.
+func (me *setNode) RankAddress(address Address) int64 {
+	if me == nil {
+		return 0
+	}
+	switch {
+	case address.lessThan(me.Prefix.Network().addr):
+		return 0
+	case me.Prefix.Broadcast().addr.lessThan(address):
+		return me.NumAddresses()
+	case me.isActive:
+		return int64(address.ui - me.Prefix.Network().addr.ui)
+	case me.isBitmap:
+		return me.bitmap().rank(address.ui & 0xff)
+	}
+	return me.Left().RankAddress(address) + me.Right().RankAddress(address)
 }
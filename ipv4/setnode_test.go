@@ -1,13 +1,34 @@
 package ipv4
 
 import (
+	"fmt"
+	"math/rand"
 	"testing"
+	"unsafe"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func printTrieSet(trie *setNode) {
-	printTrie((*trieNode)(trie))
+	if trie == nil {
+		fmt.Println("<nil>")
+		return
+	}
+	var recurse func(trie *setNode, level int)
+
+	recurse = func(trie *setNode, level int) {
+		if trie == nil {
+			return
+		}
+		for i := 0; i < level; i++ {
+			fmt.Printf("   ")
+		}
+		fmt.Printf("%+v, %v, %d\n", trie, trie.isActive, trie.size)
+		recurse(trie.children[0], level+1)
+		recurse(trie.children[1], level+1)
+	}
+
+	recurse(trie, 0)
 }
 
 func TestTrieNodeSet32Union(t *testing.T) {
@@ -485,3 +506,176 @@ func TestSetDifference(t *testing.T) {
 		assert.NotNil(t, result.Match(_p("204.0.113.128/25")))
 	})
 }
+
+func TestFlatten(t *testing.T) {
+	t.Run("active node needs no children", func(t *testing.T) {
+		prefix := _p("1.2.3.0/24")
+		n := setNode{
+			Prefix:   prefix,
+			isActive: true,
+			children: [2]*setNode{
+				&setNode{},
+				&setNode{},
+			},
+		}
+		n.flatten()
+		assert.Equal(t, prefix, n.Prefix)
+		assert.True(t, n.isActive)
+		assert.Nil(t, n.children[0])
+		assert.Nil(t, n.children[1])
+	})
+	t.Run("children of unequal size", func(t *testing.T) {
+		prefix := _p("1.2.3.0/24")
+		left := _p("1.2.3.0/26")
+		right := _p("1.2.3.128/25")
+		n := setNode{
+			Prefix: prefix,
+			children: [2]*setNode{
+				&setNode{Prefix: left},
+				&setNode{Prefix: right},
+			},
+		}
+		n.flatten()
+		assert.Equal(t, prefix, n.Prefix)
+		assert.False(t, n.isActive)
+		assert.Equal(t, left, n.children[0].Prefix)
+		assert.Equal(t, right, n.children[1].Prefix)
+	})
+	t.Run("children smaller than half", func(t *testing.T) {
+		prefix := _p("1.2.3.0/24")
+		left := _p("1.2.3.0/26")
+		right := _p("1.2.3.128/26")
+		n := setNode{
+			Prefix: prefix,
+			children: [2]*setNode{
+				&setNode{Prefix: left},
+				&setNode{Prefix: right},
+			},
+		}
+		n.flatten()
+		assert.Equal(t, prefix, n.Prefix)
+		assert.False(t, n.isActive)
+		assert.Equal(t, left, n.children[0].Prefix)
+		assert.Equal(t, right, n.children[1].Prefix)
+	})
+
+	t.Run("children not both active (left)", func(t *testing.T) {
+		prefix := _p("1.2.3.0/24")
+		left := _p("1.2.3.0/25")
+		right := _p("1.2.3.128/25")
+		n := setNode{
+			Prefix: prefix,
+			children: [2]*setNode{
+				&setNode{
+					Prefix:   left,
+					isActive: true,
+				},
+				&setNode{
+					Prefix: right,
+				},
+			},
+		}
+		n.flatten()
+		assert.Equal(t, prefix, n.Prefix)
+		assert.False(t, n.isActive)
+		assert.Equal(t, left, n.children[0].Prefix)
+		assert.Equal(t, right, n.children[1].Prefix)
+	})
+
+	t.Run("children not both active (right)", func(t *testing.T) {
+		prefix := _p("1.2.3.0/24")
+		left := _p("1.2.3.0/25")
+		right := _p("1.2.3.128/25")
+		n := setNode{
+			Prefix: prefix,
+			children: [2]*setNode{
+				&setNode{
+					Prefix: left,
+				},
+				&setNode{
+					Prefix:   right,
+					isActive: true,
+				},
+			},
+		}
+		n.flatten()
+		assert.Equal(t, prefix, n.Prefix)
+		assert.False(t, n.isActive)
+		assert.Equal(t, left, n.children[0].Prefix)
+		assert.Equal(t, right, n.children[1].Prefix)
+	})
+	t.Run("children both active", func(t *testing.T) {
+		prefix := _p("1.2.3.0/24")
+		left := _p("1.2.3.0/25")
+		right := _p("1.2.3.128/25")
+		n := setNode{
+			Prefix: prefix,
+			children: [2]*setNode{
+				&setNode{
+					Prefix:   left,
+					isActive: true,
+				},
+				&setNode{
+					Prefix:   right,
+					isActive: true,
+				},
+			},
+		}
+		n.flatten()
+		assert.Equal(t, prefix, n.Prefix)
+		assert.True(t, n.isActive)
+		assert.Nil(t, n.children[0])
+		assert.Nil(t, n.children[1])
+	})
+}
+
+func TestSetNodeSize(t *testing.T) {
+	// A set node is a trie node without the interface{} value, which is two
+	// words. With millions of prefixes in a set, it adds up.
+	trieSize := int(unsafe.Sizeof(trieNode{}))
+	setSize := int(unsafe.Sizeof(setNode{}))
+	wordSize := int(unsafe.Sizeof(uintptr(0)))
+	assert.Equal(t, trieSize-2*wordSize, setSize)
+	assert.Equal(t, intMin(40, 24+2*wordSize), setSize)
+}
+
+// benchmarkPrefixes returns the same random prefixes every time so that
+// results can be compared from one run to the next
+func benchmarkPrefixes(n int) []Prefix {
+	return randomPrefixes(rand.New(rand.NewSource(41)), n)
+}
+
+func BenchmarkSetUnion(b *testing.B) {
+	prefixes := benchmarkPrefixes(10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := NewSet_()
+		for _, p := range prefixes {
+			s.Insert(p)
+		}
+	}
+}
+
+func BenchmarkSetRemove(b *testing.B) {
+	prefixes := benchmarkPrefixes(20000)
+	full := SetFromPrefixes(prefixes[:10000])
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := full.Set_()
+		for _, p := range prefixes[10000:] {
+			s.Remove(p)
+		}
+	}
+}
+
+func BenchmarkSetDifference(b *testing.B) {
+	prefixes := benchmarkPrefixes(20000)
+	left, right := SetFromPrefixes(prefixes[:10000]), SetFromPrefixes(prefixes[10000:])
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		left.Difference(right)
+	}
+}
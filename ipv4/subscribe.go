@@ -0,0 +1,225 @@
+package ipv4
+
+import (
+	"sync"
+)
+
+// subscriber is notified after every successful modification
+type subscriber interface {
+	notify()
+}
+
+// subscribers is the list of subscriptions to a mutable type. The zero value
+// is an empty list.
+type subscribers struct {
+	lock sync.Mutex
+	list []subscriber
+}
+
+func (me *subscribers) add(s subscriber) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.list = append(me.list, s)
+}
+
+func (me *subscribers) remove(s subscriber) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	for i, existing := range me.list {
+		if existing == s {
+			// Copy so that a concurrent notify can keep using the old list
+			list := make([]subscriber, 0, len(me.list)-1)
+			list = append(list, me.list[:i]...)
+			me.list = append(list, me.list[i+1:]...)
+			return
+		}
+	}
+}
+
+func (me *subscribers) notify() {
+	me.lock.Lock()
+	list := me.list
+	me.lock.Unlock()
+
+	for _, s := range list {
+		s.notify()
+	}
+}
+
+// TableXUpdate is delivered to a TableXSubscription when the table changes.
+// Previous is the snapshot delivered by the last update (or the one current
+// when subscribing) and Current is the latest one.
+type TableXUpdate struct {
+	Previous, Current TableX
+}
+
+// Diff calls TableX.Diff to compare the previous snapshot to the current one.
+func (me TableXUpdate) Diff(changed func(p Prefix, left, right interface{}) bool, left, right, unchanged func(Prefix, interface{}) bool) bool {
+	return me.Previous.Diff(me.Current, changed, left, right, unchanged)
+}
+
+// Changeset returns the changes from the previous snapshot to the current one.
+func (me TableXUpdate) Changeset() TableXChangeset {
+	return me.Previous.Changeset(me.Current)
+}
+
+// TableXSubscription delivers a new snapshot of a TableX_ each time it is
+// modified.
+//
+// Updates are never dropped but a slow consumer doesn't hold up modifications
+// to the table either. If the table is modified again before the last update
+// has been received, the two are coalesced into one spanning from the
+// Previous of the first to the Current of the second. Intermediate versions
+// are skipped.
+type TableXSubscription struct {
+	table   TableX_
+	updates chan TableXUpdate
+
+	lock   sync.Mutex
+	last   TableX
+	closed bool
+}
+
+// Subscribe returns a new subscription to the changes made to this table
+// through this or any copy of it. Each subscription should be closed when it
+// is no longer needed.
+func (me TableX_) Subscribe() *TableXSubscription {
+	if me.m == nil {
+		panic("cannot subscribe to an unitialized Table_")
+	}
+	s := &TableXSubscription{
+		table:   me,
+		updates: make(chan TableXUpdate, 1),
+		last:    me.Table(),
+	}
+	me.m.subscribers.add(s)
+	return s
+}
+
+// Updates returns the channel where updates are delivered. It is closed when
+// the subscription is closed.
+func (me *TableXSubscription) Updates() <-chan TableXUpdate {
+	return me.updates
+}
+
+// Close stops delivery of updates and closes the Updates channel.
+func (me *TableXSubscription) Close() {
+	me.table.m.subscribers.remove(me)
+
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if !me.closed {
+		me.closed = true
+		close(me.updates)
+	}
+}
+
+func (me *TableXSubscription) notify() {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if me.closed {
+		return
+	}
+
+	// Load the latest under the lock so that concurrent notifications are
+	// always delivered in order and never go back in time.
+	current := me.table.Table()
+	if current.trie == me.last.trie {
+		return
+	}
+
+	update := TableXUpdate{me.last, current}
+	select {
+	case pending := <-me.updates:
+		update.Previous = pending.Previous
+	default:
+	}
+	// This never blocks. The channel has room for one and, holding the lock,
+	// this is the only sender.
+	me.updates <- update
+	me.last = current
+}
+
+// SetUpdate is delivered to a SetSubscription when the set changes. Previous
+// is the snapshot delivered by the last update (or the one current when
+// subscribing) and Current is the latest one.
+type SetUpdate struct {
+	Previous, Current Set
+}
+
+// Added returns the addresses in the current snapshot but not the previous.
+func (me SetUpdate) Added() Set {
+	return me.Current.Difference(me.Previous)
+}
+
+// Removed returns the addresses in the previous snapshot but not the current.
+func (me SetUpdate) Removed() Set {
+	return me.Previous.Difference(me.Current)
+}
+
+// SetSubscription delivers a new snapshot of a Set_ each time it is modified.
+// Updates are coalesced for slow consumers. See TableXSubscription.
+type SetSubscription struct {
+	set     Set_
+	updates chan SetUpdate
+
+	lock   sync.Mutex
+	last   Set
+	closed bool
+}
+
+// Subscribe returns a new subscription to the changes made to this set
+// through this or any copy of it. Each subscription should be closed when it
+// is no longer needed.
+func (me Set_) Subscribe() *SetSubscription {
+	if me.s == nil {
+		panic("cannot subscribe to an unitialized Set_")
+	}
+	s := &SetSubscription{
+		set:     me,
+		updates: make(chan SetUpdate, 1),
+		last:    me.Set(),
+	}
+	me.s.subscribers.add(s)
+	return s
+}
+
+// Updates returns the channel where updates are delivered. It is closed when
+// the subscription is closed.
+func (me *SetSubscription) Updates() <-chan SetUpdate {
+	return me.updates
+}
+
+// Close stops delivery of updates and closes the Updates channel.
+func (me *SetSubscription) Close() {
+	me.set.s.subscribers.remove(me)
+
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if !me.closed {
+		me.closed = true
+		close(me.updates)
+	}
+}
+
+func (me *SetSubscription) notify() {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if me.closed {
+		return
+	}
+
+	current := me.set.Set()
+	if current.trie == me.last.trie {
+		return
+	}
+
+	update := SetUpdate{me.last, current}
+	select {
+	case pending := <-me.updates:
+		update.Previous = pending.Previous
+	default:
+	}
+	me.updates <- update
+	me.last = current
+}
@@ -0,0 +1,132 @@
+package ipv4
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTableXSubscribe(t *testing.T) {
+	m := NewTableX_()
+	m.Insert(_p("10.0.0.0/24"), 1)
+
+	s := m.Subscribe()
+	initial := m.Table()
+
+	// Modifications through a copy are delivered too
+	func(m TableX_) {
+		m.Insert(_p("10.0.1.0/24"), 2)
+	}(m)
+
+	update := <-s.Updates()
+	assert.True(t, update.Previous.trie == initial.trie)
+	assert.True(t, update.Current.trie == m.Table().trie)
+	assert.Equal(t, TableXChangeset{
+		Added: []TableXEntry{
+			TableXEntry{_p("10.0.1.0/24"), 2},
+		},
+	}, update.Changeset())
+
+	var added []Prefix
+	update.Diff(nil, nil, func(p Prefix, _ interface{}) bool {
+		added = append(added, p)
+		return true
+	}, nil)
+	assert.Equal(t, []Prefix{_p("10.0.1.0/24")}, added)
+
+	// No-op modifications aren't delivered
+	m.Insert(_p("10.0.1.0/24"), 3)
+	select {
+	case <-s.Updates():
+		assert.Fail(t, "unexpected update")
+	default:
+	}
+
+	s.Close()
+	s.Close()
+	m.Insert(_p("10.0.2.0/24"), 4)
+	_, ok := <-s.Updates()
+	assert.False(t, ok)
+
+	assert.Panics(t, func() {
+		TableX_{}.Subscribe()
+	})
+}
+
+func TestTableXSubscribeCoalesce(t *testing.T) {
+	m := NewTableX_()
+	s := m.Subscribe()
+	defer s.Close()
+
+	// A slow consumer doesn't block modifications
+	m.Insert(_p("10.0.0.0/24"), 1)
+	m.Insert(_p("10.0.1.0/24"), 2)
+	m.Remove(_p("10.0.0.0/24"))
+	m.Insert(_p("10.0.2.0/24"), 3)
+
+	update := <-s.Updates()
+	assert.Equal(t, int64(0), update.Previous.NumEntries())
+	assert.True(t, update.Current.trie == m.Table().trie)
+	assert.Equal(t, 2, update.Changeset().NumChanges())
+
+	m.Update(_p("10.0.2.0/24"), 4)
+	update = <-s.Updates()
+	assert.Equal(t, TableXChangeset{
+		Modified: []TableXModification{
+			TableXModification{_p("10.0.2.0/24"), 3, 4},
+		},
+	}, update.Changeset())
+}
+
+func TestTableXSubscribeConcurrent(t *testing.T) {
+	m := NewTableX_().Optimistic()
+	s := m.Subscribe()
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 64; j++ {
+				m.Insert(Prefix{AddressFromBytes(10, byte(i), byte(j), 0), 24}, i)
+			}
+		}(i)
+	}
+
+	// Applying every update in order reconstructs the table
+	done := make(chan TableX)
+	go func() {
+		replica := NewTableX_()
+		for update := range s.Updates() {
+			assert.Nil(t, replica.Apply(update.Changeset()))
+		}
+		done <- replica.Table()
+	}()
+
+	wg.Wait()
+	s.Close()
+	replica := <-done
+	assert.True(t, replica.trie.Equal(m.Table().trie, ieq))
+}
+
+func TestSetSubscribe(t *testing.T) {
+	set := NewSet_()
+	set.Insert(_p("10.0.0.0/24"))
+
+	s := set.Subscribe()
+	defer s.Close()
+
+	set.Insert(_p("10.0.1.0/24"))
+	set.Remove(_p("10.0.0.0/25"))
+
+	update := <-s.Updates()
+	assert.True(t, update.Previous.Equal(_p("10.0.0.0/24").Set()))
+	assert.True(t, update.Current.Equal(set.Set()))
+	assert.True(t, update.Added().Equal(_p("10.0.1.0/24").Set()))
+	assert.True(t, update.Removed().Equal(_p("10.0.0.0/25").Set()))
+
+	assert.Panics(t, func() {
+		Set_{}.Subscribe()
+	})
+}
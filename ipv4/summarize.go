@@ -0,0 +1,301 @@
+package ipv4
+
+import "math"
+
+const infiniteCost = uint64(math.MaxUint64)
+
+func addCosts(a, b uint64) uint64 {
+	if a == infiniteCost || b == infiniteCost {
+		return infiniteCost
+	}
+	return a + b
+}
+
+// summaryNode holds what the summarizer has learned about one subtrie
+type summaryNode struct {
+	// merged is the result of merging every value in the subtrie. It is only
+	// valid if mergeable is true.
+	merged    interface{}
+	mergeable bool
+	// matched is the number of addresses matched by entries in the subtrie
+	matched uint64
+	// minimum is the fewest entries that can replace the subtrie's entries
+	// when an ancestor's entry already matches all of its addresses. Merging
+	// must not change the value of any address matched by the ancestor so
+	// only subtries that match every address in their prefix are merged.
+	minimum int
+	// costs[k] is the fewest addresses not matched by the subtrie's entries
+	// which must be swept in to replace them with at most k entries.
+	// Budgets beyond the end of the slice cost the same as the last.
+	costs []uint64
+}
+
+// exact returns true if the subtrie's entries match every address in its
+// prefix
+func (me *summaryNode) exact(n *trieNode) bool {
+	return me.matched == uint64(n.Prefix.NumAddresses())
+}
+
+// summarizer finds the fewest addresses that must be added to the addresses
+// matched by a trie to replace its entries with a limited number of entries.
+//
+// Replacing a subtrie with a single entry means merging all of its values and
+// covering it with the subtrie's prefix, the smallest prefix that can cover
+// it. Otherwise, the budget is split between the children in the best way,
+// found by dynamic programming over the trie. Since an entry already matches
+// every address under it, anything under a kept entry can be summarized
+// without sweeping in any addresses.
+type summarizer struct {
+	merge func(a, b interface{}) (interface{}, bool)
+	nodes map[*trieNode]*summaryNode
+}
+
+func (me *summarizer) cost(n *trieNode, k int) uint64 {
+	if n == nil {
+		return 0
+	}
+	costs := me.nodes[n].costs
+	if k >= len(costs) {
+		return costs[len(costs)-1]
+	}
+	return costs[k]
+}
+
+func (me *summarizer) minimum(n *trieNode) int {
+	if n == nil {
+		return 0
+	}
+	return me.nodes[n].minimum
+}
+
+// visit computes the summary of the subtrie for budgets up to max
+func (me *summarizer) visit(n *trieNode, max int) {
+	if n == nil {
+		return
+	}
+	left, right := n.children[0], n.children[1]
+	me.visit(left, max)
+	me.visit(right, max)
+
+	s := &summaryNode{}
+	me.nodes[n] = s
+
+	// Merge the values in the same order that Walk visits them
+	s.mergeable = true
+	first := true
+	if n.isActive {
+		s.merged, first = n.Data, false
+	}
+	for _, child := range n.children {
+		if child == nil {
+			continue
+		}
+		c := me.nodes[child]
+		if !c.mergeable {
+			s.mergeable = false
+			break
+		}
+		if first {
+			s.merged, first = c.merged, false
+			continue
+		}
+		if s.merged, s.mergeable = me.merge(s.merged, c.merged); !s.mergeable {
+			break
+		}
+	}
+
+	if n.isActive {
+		s.matched = uint64(n.Prefix.NumAddresses())
+	} else {
+		s.matched = me.nodes[left].matched + me.nodes[right].matched
+	}
+
+	switch {
+	case s.mergeable && s.exact(n):
+		s.minimum = 1
+	case n.isActive:
+		s.minimum = 1 + me.minimum(left) + me.minimum(right)
+	default:
+		s.minimum = me.minimum(left) + me.minimum(right)
+	}
+
+	limit := max
+	if size := int(n.NumNodes()); size < limit {
+		// Keeping every entry as it is costs nothing
+		limit = size
+	}
+	s.costs = make([]uint64, limit+1)
+	s.costs[0] = infiniteCost
+	for k := 1; k <= limit; k++ {
+		s.costs[k] = me.best(n, k)
+		if s.costs[k-1] < s.costs[k] {
+			s.costs[k] = s.costs[k-1]
+		}
+	}
+}
+
+// best returns the lowest cost of the three ways to summarize the subtrie
+// with k entries: merge it into one, keep its entry and summarize the rest
+// underneath for free, or split the budget between the children.
+func (me *summarizer) best(n *trieNode, k int) uint64 {
+	s := me.nodes[n]
+	best := infiniteCost
+	if s.mergeable {
+		best = uint64(n.Prefix.NumAddresses()) - s.matched
+	}
+	left, right := n.children[0], n.children[1]
+	if n.isActive {
+		if k-1 >= me.minimum(left)+me.minimum(right) {
+			best = 0
+		}
+		return best
+	}
+	for a := 1; a < k; a++ {
+		if cost := addCosts(me.cost(left, a), me.cost(right, k-a)); cost < best {
+			best = cost
+		}
+	}
+	return best
+}
+
+// emit appends the entries that summarize the subtrie with at most k entries
+// at the lowest cost
+func (me *summarizer) emit(n *trieNode, k int, entries []TableXEntry) []TableXEntry {
+	s := me.nodes[n]
+	if k >= len(s.costs) {
+		k = len(s.costs) - 1
+	}
+	// Use fewer entries when it costs no more
+	for k > 1 && s.costs[k-1] == s.costs[k] {
+		k--
+	}
+	cost := s.costs[k]
+
+	left, right := n.children[0], n.children[1]
+	switch {
+	case s.mergeable && uint64(n.Prefix.NumAddresses())-s.matched == cost:
+		return append(entries, TableXEntry{n.Prefix, s.merged})
+
+	case n.isActive:
+		entries = append(entries, TableXEntry{n.Prefix, n.Data})
+		entries = me.emitMinimum(left, entries)
+		return me.emitMinimum(right, entries)
+	}
+	for a := 1; a < k; a++ {
+		if addCosts(me.cost(left, a), me.cost(right, k-a)) == cost {
+			entries = me.emit(left, a, entries)
+			return me.emit(right, k-a, entries)
+		}
+	}
+	panic("no summary found with the computed cost")
+}
+
+// emitMinimum appends the fewest entries that can replace the subtrie's
+// entries under a kept entry
+func (me *summarizer) emitMinimum(n *trieNode, entries []TableXEntry) []TableXEntry {
+	if n == nil {
+		return entries
+	}
+	s := me.nodes[n]
+	if s.mergeable && s.exact(n) {
+		return append(entries, TableXEntry{n.Prefix, s.merged})
+	}
+	if n.isActive {
+		entries = append(entries, TableXEntry{n.Prefix, n.Data})
+	}
+	entries = me.emitMinimum(n.children[0], entries)
+	return me.emitMinimum(n.children[1], entries)
+}
+
+// summarize returns the entries summarizing the trie with at most max entries,
+// which must be at least 1, or false if the merge policy doesn't allow it
+func summarize(trie *trieNode, max int, merge func(a, b interface{}) (interface{}, bool)) ([]TableXEntry, bool) {
+	if trie == nil {
+		return nil, true
+	}
+	s := summarizer{
+		merge: merge,
+		nodes: map[*trieNode]*summaryNode{},
+	}
+	s.visit(trie, max)
+	if s.cost(trie, max) == infiniteCost {
+		return nil, false
+	}
+	return s.emit(trie, max, nil), true
+}
+
+// Summarize returns the set with at most maxPrefixes prefixes which contains
+// all of the addresses in this one plus the fewest extra addresses possible.
+// If the set already has no more than maxPrefixes prefixes, it is returned
+// unchanged. A maxPrefixes less than 1 is treated as 1.
+//
+// This is useful for fitting a set into something with a limited number of
+// entries, like a hardware access list. Use Difference to find the extra
+// addresses included.
+func (me Set) Summarize(maxPrefixes int) Set {
+	if maxPrefixes < 1 {
+		maxPrefixes = 1
+	}
+	if me.trie.NumNodes() <= int64(maxPrefixes) {
+		return me
+	}
+
+	var entries []TableXEntry
+	me.WalkPrefixes(func(p Prefix) bool {
+		entries = append(entries, TableXEntry{Prefix: p})
+		return true
+	})
+	// This can't fail because the prefixes come sorted from a set
+	table, _ := TableXFromSorted(entries)
+	summary, _ := summarize(table.trie, maxPrefixes, func(a, b interface{}) (interface{}, bool) {
+		return nil, true
+	})
+
+	prefixes := make([]Prefix, len(summary))
+	for i, e := range summary {
+		prefixes[i] = e.Prefix
+	}
+	return SetFromPrefixes(prefixes)
+}
+
+// Summarize returns a table with at most maxEntries entries which matches
+// all of the addresses that this one does, plus the fewest extra addresses
+// possible, by merging entries together. The addresses that are matched by
+// the summary but not by this table are returned as swept.
+//
+// Entries are merged by replacing them with a single entry for a prefix that
+// contains them all. The merge policy decides whether two values can be
+// merged and what the value of the merged entry is. It is called with values
+// in the order that Walk visits them. Values may be merged with the value of a
+// shorter prefix that contains them, in which case, no new addresses are
+// matched but the value changes for some addresses; the policy should refuse
+// merges where this isn't acceptable.
+//
+// A maxEntries less than 1 is treated as 1, like in Set.Summarize. If the
+// table can't be summarized with so few entries because of the merge policy,
+// ok is false and the table is returned unchanged.
+func (me TableX) Summarize(maxEntries int, merge func(a, b interface{}) (merged interface{}, ok bool)) (summary TableX, swept Set, ok bool) {
+	if maxEntries < 1 {
+		maxEntries = 1
+	}
+	if me.NumEntries() <= int64(maxEntries) {
+		return me, Set{}, true
+	}
+	entries, ok := summarize(me.trie, maxEntries, merge)
+	if !ok {
+		return me, Set{}, false
+	}
+	// This can't fail because the entries are emitted in order
+	summary, _ = TableXFromSorted(entries)
+	summary.eq = me.eq
+
+	matched := func(t TableX) Set {
+		var prefixes []Prefix
+		t.Walk(func(p Prefix, _ interface{}) bool {
+			prefixes = append(prefixes, p)
+			return true
+		})
+		return SetFromPrefixes(prefixes)
+	}
+	return summary, matched(summary).Difference(matched(me)), true
+}
@@ -0,0 +1,243 @@
+package ipv4
+
+import (
+	"math/bits"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setFromStrings(cidrs ...string) Set {
+	prefixes := make([]Prefix, len(cidrs))
+	for i, cidr := range cidrs {
+		prefixes[i] = _p(cidr)
+	}
+	return SetFromPrefixes(prefixes)
+}
+
+func TestSetSummarize(t *testing.T) {
+	tests := []struct {
+		description string
+		set         Set
+		max         int
+		expected    Set
+	}{
+		{
+			description: "empty",
+			set:         Set{},
+			max:         1,
+			expected:    Set{},
+		}, {
+			description: "already small enough",
+			set:         setFromStrings("10.0.0.0/24", "10.0.2.0/24"),
+			max:         2,
+			expected:    setFromStrings("10.0.0.0/24", "10.0.2.0/24"),
+		}, {
+			description: "closest pair",
+			set:         setFromStrings("10.0.0.0/24", "10.0.1.128/25", "10.0.3.0/24"),
+			max:         2,
+			expected:    setFromStrings("10.0.0.0/23", "10.0.3.0/24"),
+		}, {
+			description: "one",
+			set:         setFromStrings("10.0.0.0/24", "10.0.1.128/25", "10.0.3.0/24"),
+			max:         1,
+			expected:    setFromStrings("10.0.0.0/22"),
+		}, {
+			description: "less than one",
+			set:         setFromStrings("10.0.0.1/32", "10.0.0.6/32"),
+			max:         0,
+			expected:    setFromStrings("10.0.0.0/29"),
+		}, {
+			description: "smallest gap",
+			set:         setFromStrings("10.0.0.0/32", "10.0.0.3/32", "10.0.0.4/30", "10.0.0.8/32", "10.0.0.15/32"),
+			max:         3,
+			expected:    setFromStrings("10.0.0.0/29", "10.0.0.8/32", "10.0.0.15/32"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			summary := tt.set.Summarize(tt.max)
+			assert.True(t, summary.isValid())
+			assert.True(t, summary.Equal(tt.expected), summary.String())
+		})
+	}
+}
+
+// bestSummary finds the fewest extra addresses needed to cover the set with
+// at most max prefixes by trying every combination of prefixes in a /29
+func bestSummary(set Set, max int) int64 {
+	base := _p("10.0.0.0/29")
+	var prefixes []Prefix
+	for length := uint32(29); length <= 32; length++ {
+		for i := uint32(0); i < 1<<(length-29); i++ {
+			prefixes = append(prefixes, Prefix{Address{base.addr.ui + i<<(32-length)}, length})
+		}
+	}
+
+	best := int64(-1)
+	for combination := 0; combination < 1<<len(prefixes); combination++ {
+		if bits.OnesCount(uint(combination)) > max {
+			continue
+		}
+		s := NewSet_()
+		for i, p := range prefixes {
+			if combination&(1<<i) != 0 {
+				s.Insert(p)
+			}
+		}
+		if !s.Contains(set) {
+			continue
+		}
+		extra := s.NumAddresses() - set.NumAddresses()
+		if best < 0 || extra < best {
+			best = extra
+		}
+	}
+	return best
+}
+
+func TestSetSummarizeOptimal(t *testing.T) {
+	r := rand.New(rand.NewSource(44))
+
+	for i := 0; i < 30; i++ {
+		s := NewSet_()
+		for _, offset := range r.Perm(8)[:1+r.Intn(6)] {
+			s.Insert(Address{_a("10.0.0.0").ui + uint32(offset)})
+		}
+		set := s.Set()
+
+		for max := 1; max <= 4; max++ {
+			summary := set.Summarize(max)
+			require.True(t, summary.isValid())
+			assert.LessOrEqual(t, summary.trie.NumNodes(), int64(max))
+			assert.True(t, summary.Contains(set))
+			assert.Equal(t, bestSummary(set, max), summary.NumAddresses()-set.NumAddresses(), "%s summarized to %d", set, max)
+		}
+	}
+}
+
+func TestSetSummarizeLarge(t *testing.T) {
+	r := rand.New(rand.NewSource(45))
+
+	set := SetFromPrefixes(randomPrefixes(r, 1000))
+	previous := set
+	for _, max := range []int{500, 100, 20, 1} {
+		summary := set.Summarize(max)
+		require.True(t, summary.isValid())
+		assert.LessOrEqual(t, summary.trie.NumNodes(), int64(max))
+		assert.True(t, summary.Contains(set))
+		// A smaller budget never needs fewer extra addresses
+		assert.GreaterOrEqual(t, summary.NumAddresses(), previous.NumAddresses())
+		previous = summary
+	}
+}
+
+func TestTableXSummarize(t *testing.T) {
+	equalValues := func(a, b interface{}) (interface{}, bool) {
+		return a, a == b
+	}
+
+	table := NewTableX_()
+	table.Insert(_p("10.0.0.0/24"), 1)
+	table.Insert(_p("10.0.1.0/25"), 1)
+	table.Insert(_p("10.0.2.0/24"), 2)
+	table.Insert(_p("10.0.3.0/24"), 2)
+	table.Insert(_p("10.0.3.4/32"), 3)
+
+	t.Run("already small enough", func(t *testing.T) {
+		summary, swept, ok := table.Table().Summarize(5, equalValues)
+		assert.True(t, ok)
+		assert.Equal(t, int64(0), swept.NumAddresses())
+		assert.True(t, summary.trie.Equal(table.Table().trie, ieq))
+	})
+
+	t.Run("equal values", func(t *testing.T) {
+		summary, swept, ok := table.Table().Summarize(4, equalValues)
+		require.True(t, ok)
+		assert.True(t, summary.trie.isValid())
+		assert.Equal(t, int64(4), summary.NumEntries())
+		assert.True(t, swept.Equal(_p("10.0.1.128/25").Set()))
+
+		expected := NewTableX_()
+		expected.Insert(_p("10.0.0.0/23"), 1)
+		expected.Insert(_p("10.0.2.0/24"), 2)
+		expected.Insert(_p("10.0.3.0/24"), 2)
+		expected.Insert(_p("10.0.3.4/32"), 3)
+		assert.True(t, summary.trie.Equal(expected.Table().trie, ieq))
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		// 10.0.3.0/24 can't be merged with the /32 under it
+		summary, swept, ok := table.Table().Summarize(3, equalValues)
+		assert.False(t, ok)
+		assert.Equal(t, int64(0), swept.NumAddresses())
+		assert.True(t, summary.trie.Equal(table.Table().trie, ieq))
+	})
+
+	t.Run("any values", func(t *testing.T) {
+		var merged [][2]interface{}
+		summary, swept, ok := table.Table().Summarize(1, func(a, b interface{}) (interface{}, bool) {
+			merged = append(merged, [2]interface{}{a, b})
+			return a.(int) + b.(int), true
+		})
+		require.True(t, ok)
+		assert.Equal(t, int64(1), summary.NumEntries())
+		value, found := summary.Get(_p("10.0.0.0/22"))
+		assert.True(t, found)
+		assert.Equal(t, 9, value)
+		assert.True(t, swept.Equal(_p("10.0.1.128/25").Set()))
+		assert.NotEmpty(t, merged)
+
+		// Less than 1 is treated as 1, like for a set
+		clamped, _, ok := table.Table().Summarize(0, func(a, b interface{}) (interface{}, bool) {
+			return a.(int) + b.(int), true
+		})
+		require.True(t, ok)
+		assert.True(t, clamped.trie.Equal(summary.trie, ieq))
+	})
+}
+
+func TestTableXSummarizeSwept(t *testing.T) {
+	r := rand.New(rand.NewSource(46))
+
+	table := NewTableX_()
+	for _, p := range randomPrefixes(r, 500) {
+		// Nested prefixes have the same value so that they can be merged
+		table.InsertOrUpdate(p, p.addr.ui>>28)
+	}
+	original := table.Table()
+
+	summary, swept, ok := original.Summarize(100, func(a, b interface{}) (interface{}, bool) {
+		return a, a == b
+	})
+	require.True(t, ok)
+	assert.True(t, summary.trie.isValid())
+	assert.LessOrEqual(t, summary.NumEntries(), int64(100))
+
+	// Every address matched before must still be matched with the same value
+	// since only equal values were merged
+	original.Walk(func(p Prefix, value interface{}) bool {
+		for _, a := range []Address{p.Network().addr, p.Broadcast().addr} {
+			expected, _, _ := original.LongestMatch(a)
+			actual, found, _ := summary.LongestMatch(a)
+			assert.True(t, found)
+			assert.Equal(t, expected, actual, a.String())
+		}
+		return true
+	})
+
+	// The swept addresses are exactly those matched only by the summary
+	covered := func(t TableX) Set {
+		s := NewSet_()
+		t.Walk(func(p Prefix, _ interface{}) bool {
+			s.Insert(p)
+			return true
+		})
+		return s.Set()
+	}
+	assert.True(t, swept.Equal(covered(summary).Difference(covered(original))))
+	assert.Equal(t, int64(0), swept.Intersection(covered(original)).NumAddresses())
+}
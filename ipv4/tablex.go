@@ -1,5 +1,7 @@
 package ipv4
 
+import "sync"
+
 // TableX_ is a mutable version of TableX, allowing inserting, replacing, or
 // removing elements in various ways. You can use it as an TableX builder or on
 // its own.
@@ -7,14 +9,31 @@ package ipv4
 // The zero value of a TableX_ is unitialized. Reading it is equivalent to
 // reading an empty TableX_. Attempts to modify it will result in a panic.
 // Always use NewTableX_() to get an initialized TableX_.
+//
+// By default, a TableX_ does not support concurrent modification. If two
+// goroutines modify it at the same time, one of them will panic. See
+// Optimistic for a mode that supports multiple concurrent writers.
 type TableX_ struct {
-	// This is an abuse of TableX because it uses its package privileges
-	// to turn it into a mutable one. This could be refactored to be cleaner
-	// without changing the interface.
+	// All copies of a TableX_ share this state. Be careful not to take a
+	// TableX from outside the package and turn it into a mutable one by
+	// pointing at it. That would break the contract.
+	m *mutableTableX
 
-	// Be careful not to take an TableX from outside the package and turn
-	// it into a mutable one. That would break the contract.
-	m *TableX
+	// optimistic, when set, retries a modification against the new contents
+	// of the table instead of panicking when a concurrent one is detected.
+	optimistic bool
+}
+
+// mutableTableX is the state shared by all copies of a TableX_. The embedded
+// TableX's trie is only ever swapped atomically.
+type mutableTableX struct {
+	TableX
+	subscribers subscribers
+
+	// lock is held for reading while swapping the trie and for writing while
+	// attaching or detaching the journal
+	lock    sync.RWMutex
+	journal *TableXJournal
 }
 
 func defaultComparator(a, b interface{}) bool {
@@ -25,9 +44,11 @@ func defaultComparator(a, b interface{}) bool {
 // are comparable with ==.
 func NewTableX_() TableX_ {
 	return TableX_{
-		&TableX{
-			nil,
-			defaultComparator,
+		m: &mutableTableX{
+			TableX: TableX{
+				nil,
+				defaultComparator,
+			},
 		},
 	}
 }
@@ -36,9 +57,11 @@ func NewTableX_() TableX_ {
 // data that can be compared used a comparator that you pass.
 func NewTableXCustomCompare_(comparator func(a, b interface{}) bool) TableX_ {
 	return TableX_{
-		&TableX{
-			nil,
-			comparator,
+		m: &mutableTableX{
+			TableX: TableX{
+				nil,
+				comparator,
+			},
 		},
 	}
 }
@@ -57,23 +80,87 @@ const (
 
 // NumEntries returns the number of exact prefixes stored in the table
 func (me TableX_) NumEntries() int64 {
-	if me.m == nil {
-		return 0
-	}
-	return me.m.NumEntries()
+	return me.Table().NumEntries()
 }
 
-// mutate should be called by any method that modifies the table in any way
-func (me TableX_) mutate(mutator func() (ok bool, node *trieNode)) {
-	oldNode := me.m.trie
-	ok, newNode := mutator()
-	if ok && oldNode != newNode {
-		if !swapTrieNodePtr(&me.m.trie, oldNode, newNode) {
+// Optimistic returns a TableX_ that refers to the same table as this one but
+// supports lock-free concurrent modification from multiple goroutines. Instead
+// of panicking when a concurrent modification is detected, each modification
+// made through it is retried against the new contents of the table until it
+// succeeds.
+//
+// Modifications made through the original TableX_, or any other copy not in
+// optimistic mode, continue to panic.
+func (me TableX_) Optimistic() TableX_ {
+	me.optimistic = true
+	return me
+}
+
+// root atomically loads the root of the trie
+func (me TableX_) root() *trieNode {
+	return loadTrieNodePtr(&me.m.trie)
+}
+
+// mutate should be called by any method that modifies the table in any way.
+// The mutator must compute the new root from the result of calling root().
+// In optimistic mode, it may be called more than once. It returns an error,
+// leaving the table unmodified, if the modification can't be journaled.
+func (me TableX_) mutate(mutator func() (ok bool, node *trieNode)) error {
+	for {
+		oldNode := me.root()
+		ok, newNode := mutator()
+		if !ok || oldNode == newNode {
+			return nil
+		}
+		swapped, err := me.m.swap(oldNode, newNode)
+		if err != nil {
+			return err
+		}
+		if swapped {
+			me.m.subscribers.notify()
+			return nil
+		}
+		if !me.optimistic {
 			panic("concurrent modification of Table_ detected")
 		}
 	}
 }
 
+// swap atomically replaces the root of the trie if it is still oldNode. If
+// the table is being journaled, the change is written to the journal first and
+// the root is only replaced if that succeeds.
+func (me *mutableTableX) swap(oldNode, newNode *trieNode) (bool, error) {
+	me.lock.RLock()
+	defer me.lock.RUnlock()
+	if me.journal != nil {
+		return me.journal.commit(oldNode, newNode)
+	}
+	return swapTrieNodePtr(&me.trie, oldNode, newNode), nil
+}
+
+// Transact applies a batch of modifications to the table atomically. It calls
+// the given callback with a mutable copy of the current contents. If the
+// callback returns true, all of its modifications are made visible at once and
+// Transact returns true. Otherwise, they are discarded and it returns false.
+//
+// In optimistic mode, the callback is called again with the new contents if
+// another goroutine modified the table in the meantime so it should not have
+// side effects outside of the TableX_ it is passed.
+func (me TableX_) Transact(transaction func(TableX_) bool) (committed bool) {
+	if me.m == nil {
+		panic("cannot modify an unitialized Table_")
+	}
+	err := me.mutate(func() (bool, *trieNode) {
+		t_ := TableX{me.root(), me.m.eq}.Table_()
+		committed = transaction(t_)
+		if !committed {
+			return false, nil
+		}
+		return true, t_.m.trie
+	})
+	return committed && err == nil
+}
+
 // Insert inserts the given prefix with the given value into the table.
 // If an entry with the same prefix already exists, it will not overwrite it
 // and return false.
@@ -85,14 +172,16 @@ func (me TableX_) Insert(prefix PrefixI, value interface{}) (succeeded bool) {
 		prefix = Prefix{}
 	}
 	var err error
-	me.mutate(func() (bool, *trieNode) {
+	if me.mutate(func() (bool, *trieNode) {
 		var newHead *trieNode
-		newHead, err = me.m.trie.Insert(prefix.Prefix(), value)
+		newHead, err = me.root().Insert(prefix.Prefix(), value)
 		if err != nil {
 			return false, nil
 		}
 		return true, newHead
-	})
+	}) != nil {
+		return false
+	}
 	return err == nil
 }
 
@@ -107,19 +196,24 @@ func (me TableX_) Update(prefix PrefixI, value interface{}) (succeeded bool) {
 		prefix = Prefix{}
 	}
 	var err error
-	me.mutate(func() (bool, *trieNode) {
+	if me.mutate(func() (bool, *trieNode) {
 		var newHead *trieNode
-		newHead, err = me.m.trie.Update(prefix.Prefix(), value, me.m.eq)
+		newHead, err = me.root().Update(prefix.Prefix(), value, me.m.eq)
 		if err != nil {
 			return false, nil
 		}
 		return true, newHead
-	})
+	}) != nil {
+		return false
+	}
 	return err == nil
 }
 
 // InsertOrUpdate inserts the given prefix with the given value into the table.
 // If the prefix already existed, it updates the associated value in place.
+//
+// If the table is journaled and the change can't be recorded, the table is
+// left unmodified; check TableXJournal.Err to find out.
 func (me TableX_) InsertOrUpdate(prefix PrefixI, value interface{}) {
 	if me.m == nil {
 		panic("cannot modify an unitialized Table_")
@@ -128,7 +222,26 @@ func (me TableX_) InsertOrUpdate(prefix PrefixI, value interface{}) {
 		prefix = Prefix{}
 	}
 	me.mutate(func() (bool, *trieNode) {
-		return true, me.m.trie.InsertOrUpdate(prefix.Prefix(), value, me.m.eq)
+		return true, me.root().InsertOrUpdate(prefix.Prefix(), value, me.m.eq)
+	})
+}
+
+// RemoveSet punches a hole in the table removing all of the addresses in the
+// given set. Any entry that covers part of the set is split so that a longest
+// prefix match for any address outside of the set still returns the same value
+// as before. See TableX.RemoveSet for details.
+//
+// If the table is journaled and the change can't be recorded, the table is
+// left unmodified; check TableXJournal.Err to find out.
+func (me TableX_) RemoveSet(set SetI) {
+	if me.m == nil {
+		panic("cannot modify an unitialized Table_")
+	}
+	if set == nil {
+		set = Set{}
+	}
+	me.mutate(func() (bool, *trieNode) {
+		return true, me.root().RemoveSet(set.Set().trie)
 	})
 }
 
@@ -137,15 +250,15 @@ func (me TableX_) InsertOrUpdate(prefix PrefixI, value interface{}) {
 // exact match is not found, found is false and value is nil and should be
 // ignored.
 func (me TableX_) Get(prefix PrefixI) (interface{}, bool) {
-	if me.m == nil {
-		return nil, false
-	}
-	return me.m.Get(prefix)
+	return me.Table().Get(prefix)
 }
 
 // GetOrInsert returns the value associated with the given prefix if it already
 // exists. If it does not exist, it inserts it with the given value and returns
 // that.
+//
+// If the table is journaled and the insert can't be recorded, nothing is
+// inserted and it returns nil; check TableXJournal.Err to find out.
 func (me TableX_) GetOrInsert(prefix PrefixI, value interface{}) interface{} {
 	if me.m == nil {
 		panic("cannot modify an unitialized Table_")
@@ -154,11 +267,14 @@ func (me TableX_) GetOrInsert(prefix PrefixI, value interface{}) interface{} {
 		prefix = Prefix{}
 	}
 	var node *trieNode
-	me.mutate(func() (bool, *trieNode) {
+	if me.mutate(func() (bool, *trieNode) {
 		var newHead *trieNode
-		newHead, node = me.m.trie.GetOrInsert(prefix.Prefix(), value)
+		newHead, node = me.root().GetOrInsert(prefix.Prefix(), value)
 		return true, newHead
-	})
+	}) != nil {
+		// The prefix wasn't there or there would have been nothing to record
+		return nil
+	}
 	return node.Data
 }
 
@@ -167,10 +283,7 @@ func (me TableX_) GetOrInsert(prefix PrefixI, value interface{}) interface{} {
 // Prefix matched, which may be equal to or shorter than the one passed. If no
 // match is found, returns nil, false, and matchPrefix must be ignored.
 func (me TableX_) LongestMatch(prefix PrefixI) (value interface{}, found bool, matchPrefix Prefix) {
-	if me.m == nil {
-		return nil, false, Prefix{}
-	}
-	return me.m.LongestMatch(prefix)
+	return me.Table().LongestMatch(prefix)
 }
 
 // Remove removes the given prefix from the table with its associated value and
@@ -185,11 +298,13 @@ func (me TableX_) Remove(prefix PrefixI) (succeeded bool) {
 		prefix = Prefix{}
 	}
 	var err error
-	me.mutate(func() (bool, *trieNode) {
+	if me.mutate(func() (bool, *trieNode) {
 		var newHead *trieNode
-		newHead, err = me.m.trie.Delete(prefix.Prefix())
+		newHead, err = me.root().Delete(prefix.Prefix())
 		return true, newHead
-	})
+	}) != nil {
+		return false
+	}
 	return err == nil
 }
 
@@ -200,7 +315,7 @@ func (me TableX_) Table() TableX {
 	if me.m == nil {
 		return TableX{}
 	}
-	return *me.m
+	return TableX{me.root(), me.m.eq}
 }
 
 // TableX is a structure that maps IP prefixes to values. For example, the
@@ -228,7 +343,7 @@ func (me TableX) Table_() TableX_ {
 	if me.eq == nil {
 		me.eq = defaultComparator
 	}
-	return TableX_{&me}
+	return TableX_{m: &mutableTableX{TableX: me}}
 }
 
 // Build is a convenience method for making modifications to a table within a
@@ -327,6 +442,121 @@ func (me TableX) Aggregate() TableX {
 	}
 }
 
+// AggregateWith is like Aggregate but, instead of requiring values to be
+// equal, it folds them together using `combine`. This is useful for tables of
+// counters, for example, where the values can be summed.
+//
+// Like Aggregate, it works from the longest prefixes up. When the two halves
+// of a prefix both have entries, they are replaced by a single entry for the
+// prefix with the combined value. When an entry contains another with no
+// intermediate entry between them, the value of the longer one is folded into
+// it and the longer one is removed. Each merge only happens if `shouldMerge`
+// returns true when called with the prefix of the resulting entry, the value
+// that it has so far, and the value to fold into it. Values are folded in the
+// order that Walk visits them.
+//
+// To fold everything up to a certain prefix, like a /16, the table must have
+// an entry for it. Inserting one with a zero value works for counters.
+func (me TableX) AggregateWith(combine func(a, b interface{}) interface{}, shouldMerge func(p Prefix, a, b interface{}) bool) TableX {
+	// This can't fail because the entries are returned in order
+	table, _ := TableXFromSorted(me.trie.aggregateWith(combine, shouldMerge))
+	table.eq = me.eq
+	return table
+}
+
+// Disaggregate is the opposite of Aggregate. It returns a table where no two
+// prefixes overlap and each one maps to the same value that LongestMatch
+// returns for every address in it. Each entry that contains others is split
+// into the fewest prefixes needed to cover the addresses around them.
+//
+// This is useful for programming something that doesn't support longest
+// prefix matching or for exporting the table as a flat list.
+func (me TableX) Disaggregate() TableX {
+	if me.trie == nil {
+		return me
+	}
+	// This can't fail because the entries are returned in order
+	table, _ := TableXFromSorted(me.trie.disaggregate(me.trie.Prefix.Network(), nil, nil))
+	table.eq = me.eq
+	return table
+}
+
+// TableXValueSet pairs a value with the set of addresses for which a
+// table's LongestMatch returns it
+type TableXValueSet struct {
+	Value interface{}
+	Set   Set
+}
+
+// EffectiveSets returns, for each distinct value in the table, the set of
+// addresses whose longest match has that value. Entries that are completely
+// shadowed by longer prefixes don't contribute any addresses so their values
+// may not appear at all. Values are compared using the table's comparator
+// and are returned in the order of the first address that maps to each one.
+//
+// Since values can only be compared with the comparator, this takes time
+// proportional to the number of entries times the number of distinct values.
+func (me TableX) EffectiveSets() []TableXValueSet {
+	if me.trie == nil {
+		return nil
+	}
+	eq := me.eq
+	if eq == nil {
+		eq = defaultComparator
+	}
+
+	var values []interface{}
+	var prefixes [][]Prefix
+	last := -1
+	for _, e := range me.trie.disaggregate(me.trie.Prefix.Network(), nil, nil) {
+		// Consecutive entries often have the same value so try that first
+		if last < 0 || !eq(values[last], e.Value) {
+			last = -1
+			for i, value := range values {
+				if eq(value, e.Value) {
+					last = i
+					break
+				}
+			}
+			if last < 0 {
+				last = len(values)
+				values = append(values, e.Value)
+				prefixes = append(prefixes, nil)
+			}
+		}
+		prefixes[last] = append(prefixes[last], e.Prefix)
+	}
+
+	sets := make([]TableXValueSet, len(values))
+	for i, value := range values {
+		// The prefixes are already sorted so this takes linear time
+		sets[i] = TableXValueSet{value, SetFromPrefixes(prefixes[i])}
+	}
+	return sets
+}
+
+// NthEntry returns the prefix/value pair at the given index in the order that
+// Walk visits them. If the index is out of range, found is false. It takes
+// time proportional to the height of the underlying structure, not the number
+// of entries.
+func (me TableX) NthEntry(index int64) (prefix Prefix, value interface{}, found bool) {
+	node := me.trie.Nth(index)
+	if node == nil {
+		return Prefix{}, nil, false
+	}
+	return node.Prefix, node.Data, true
+}
+
+// Rank returns the number of entries that come before the given prefix in the
+// order that Walk visits them. The prefix doesn't need to exist in the table.
+// If it does, NthEntry(Rank(prefix)) returns it.
+func (me TableX) Rank(prefix PrefixI) int64 {
+	if prefix == nil {
+		prefix = Prefix{}
+	}
+	return me.trie.Rank(prefix.Prefix())
+}
+
 // Walk invokes the given callback function for each prefix/value pair in
 // the table in lexigraphical order.
 //
@@ -336,6 +566,12 @@ func (me TableX) Walk(callback func(Prefix, interface{}) bool) bool {
 	return me.trie.Walk(callback)
 }
 
+// WalkReverse is like Walk but visits the prefix/value pairs in reverse
+// lexigraphical order.
+func (me TableX) WalkReverse(callback func(Prefix, interface{}) bool) bool {
+	return me.trie.WalkReverse(callback)
+}
+
 // Diff invokes the given callback functions for each prefix/value pair in the
 // table in lexigraphical order.
 //
@@ -404,3 +640,62 @@ func (me TableX) Map(mapper func(Prefix, interface{}) interface{}) TableX {
 		me.eq,
 	}
 }
+
+// Filter returns a new table with only the prefix/value pairs for which the
+// given predicate returns true. The predicate is called for each pair in the
+// table in lexigraphical order.
+//
+// Like Map, Filter builds the result in time linear in the number of entries
+// and shares any unchanged parts of the underlying structure with the
+// original table.
+func (me TableX) Filter(predicate func(Prefix, interface{}) bool) TableX {
+	if predicate == nil {
+		return me
+	}
+	return TableX{
+		me.trie.Filter(predicate),
+		me.eq,
+	}
+}
+
+// Restrict returns a new table with only the entries whose prefixes are
+// entirely contained in the given set. Entries whose prefixes only partially
+// overlap the set are not included.
+func (me TableX) Restrict(set SetI) TableX {
+	if set == nil {
+		set = Set{}
+	}
+	s := set.Set()
+	return me.Filter(func(p Prefix, _ interface{}) bool {
+		return s.trie.Match(p) != nil
+	})
+}
+
+// Exclude returns a new table without any of the entries whose prefixes are
+// entirely contained in the given set. It is the complement of Restrict:
+// every entry in the table appears in exactly one of the two results.
+func (me TableX) Exclude(set SetI) TableX {
+	if set == nil {
+		set = Set{}
+	}
+	s := set.Set()
+	return me.Filter(func(p Prefix, _ interface{}) bool {
+		return s.trie.Match(p) == nil
+	})
+}
+
+// RemoveSet punches a hole in the table removing all of the addresses in the
+// given set. Any entry that covers part of the set is split into the smallest
+// set of prefixes that cover the rest of it, each with the original value.
+// Entries entirely inside the set are removed. A longest prefix match for any
+// address outside of the set returns the same value as before; a match for
+// any address inside of it finds nothing.
+func (me TableX) RemoveSet(set SetI) TableX {
+	if set == nil {
+		set = Set{}
+	}
+	return TableX{
+		me.trie.RemoveSet(set.Set().trie),
+		me.eq,
+	}
+}
@@ -1,10 +1,12 @@
 package ipv4
 
 import (
+	"math/rand"
 	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestInsertOrUpdate(t *testing.T) {
@@ -556,6 +558,226 @@ func TestTableWalkAggregates(t *testing.T) {
 	assert.True(t, m.m.trie.isValid())
 }
 
+func TestTableAggregateWith(t *testing.T) {
+	sum := func(a, b interface{}) interface{} {
+		return a.(int) + b.(int)
+	}
+	upTo := func(length int) func(Prefix, interface{}, interface{}) bool {
+		return func(p Prefix, _, _ interface{}) bool {
+			return p.Length() >= length
+		}
+	}
+	entries := func(table TableX) map[string]interface{} {
+		result := map[string]interface{}{}
+		table.Walk(func(p Prefix, value interface{}) bool {
+			result[p.String()] = value
+			return true
+		})
+		return result
+	}
+
+	counters := NewTableX_()
+	counters.Insert(_p("10.0.0.0/16"), 0)
+	counters.Insert(_p("10.0.1.0/24"), 100)
+	counters.Insert(_p("10.0.1.7/32"), 5)
+	counters.Insert(_p("10.0.2.0/25"), 10)
+	counters.Insert(_p("10.0.2.128/25"), 20)
+	counters.Insert(_p("10.1.0.0/24"), 7)
+	counters.Insert(_p("10.1.1.0/24"), 8)
+
+	t.Run("up to a /16", func(t *testing.T) {
+		aggregated := counters.Table().AggregateWith(sum, upTo(16))
+		assert.True(t, aggregated.trie.isValid())
+		assert.Equal(t, map[string]interface{}{
+			"10.0.0.0/16": 135,
+			"10.1.0.0/23": 15,
+		}, entries(aggregated))
+	})
+
+	t.Run("siblings only", func(t *testing.T) {
+		aggregated := counters.Table().AggregateWith(sum, upTo(24))
+		assert.True(t, aggregated.trie.isValid())
+		assert.Equal(t, map[string]interface{}{
+			"10.0.0.0/16": 0,
+			"10.0.1.0/24": 105,
+			"10.0.2.0/24": 30,
+			"10.1.0.0/24": 7,
+			"10.1.1.0/24": 8,
+		}, entries(aggregated))
+	})
+
+	t.Run("skip a level", func(t *testing.T) {
+		aggregated := counters.Table().AggregateWith(sum, func(p Prefix, _, _ interface{}) bool {
+			return p.Length() != 24
+		})
+		assert.True(t, aggregated.trie.isValid())
+		// The /32 isn't folded into the /24 but both are folded into the /16
+		assert.Equal(t, map[string]interface{}{
+			"10.0.0.0/16": 135,
+			"10.1.0.0/23": 15,
+		}, entries(aggregated))
+	})
+
+	t.Run("never", func(t *testing.T) {
+		aggregated := counters.Table().AggregateWith(sum, func(Prefix, interface{}, interface{}) bool {
+			return false
+		})
+		assert.True(t, aggregated.trie.Equal(counters.Table().trie, ieq))
+	})
+
+	t.Run("equal values", func(t *testing.T) {
+		// Merging only equal values doesn't change any longest match
+		r := rand.New(rand.NewSource(45))
+		table := NewTableX_()
+		for _, p := range randomPrefixes(r, 1000) {
+			table.InsertOrUpdate(p, p.Length()%2)
+		}
+		aggregated := table.Table().AggregateWith(func(a, b interface{}) interface{} {
+			return a
+		}, func(_ Prefix, a, b interface{}) bool {
+			return a == b
+		})
+		assert.True(t, aggregated.trie.isValid())
+		assert.Less(t, aggregated.NumEntries(), table.NumEntries())
+		table.Table().Walk(func(p Prefix, _ interface{}) bool {
+			for _, a := range []Address{p.Network().addr, p.Broadcast().addr} {
+				expected, _, _ := table.LongestMatch(a)
+				actual, _, _ := aggregated.LongestMatch(a)
+				assert.Equal(t, expected, actual, a.String())
+			}
+			return true
+		})
+	})
+}
+
+func TestTableDisaggregate(t *testing.T) {
+	t.Run("empty", func(t *testing.T) {
+		assert.Equal(t, int64(0), TableX{}.Disaggregate().NumEntries())
+	})
+
+	t.Run("example", func(t *testing.T) {
+		m := NewTableX_()
+		m.Insert(_p("10.0.0.0/22"), 1)
+		m.Insert(_p("10.0.1.0/24"), 2)
+		m.Insert(_p("10.0.1.128/25"), 1)
+		m.Insert(_p("10.0.2.4/30"), 3)
+		m.Insert(_p("10.1.0.0/24"), 4)
+
+		var result []pair
+		m.Table().Disaggregate().Walk(func(prefix Prefix, value interface{}) bool {
+			result = append(result, pair{prefix.String(), value})
+			return true
+		})
+		assert.Equal(t, []pair{
+			{"10.0.0.0/24", 1},
+			{"10.0.1.0/25", 2},
+			{"10.0.1.128/25", 1},
+			{"10.0.2.0/30", 1},
+			{"10.0.2.4/30", 3},
+			{"10.0.2.8/29", 1},
+			{"10.0.2.16/28", 1},
+			{"10.0.2.32/27", 1},
+			{"10.0.2.64/26", 1},
+			{"10.0.2.128/25", 1},
+			{"10.0.3.0/24", 1},
+			{"10.1.0.0/24", 4},
+		}, result)
+	})
+
+	t.Run("random", func(t *testing.T) {
+		r := rand.New(rand.NewSource(46))
+		m := NewTableX_()
+		for _, p := range randomPrefixes(r, 1000) {
+			m.InsertOrUpdate(p, p.Length())
+		}
+		table := m.Table()
+		flat := table.Disaggregate()
+		assert.True(t, flat.trie.isValid())
+
+		// No two prefixes overlap and every address keeps its value
+		covered := NewSet_()
+		var total int64
+		flat.Walk(func(p Prefix, value interface{}) bool {
+			covered.Insert(p)
+			total += p.NumAddresses()
+			for _, a := range []Address{p.Network().addr, p.Broadcast().addr} {
+				expected, found, _ := table.LongestMatch(a)
+				assert.True(t, found)
+				assert.Equal(t, expected, value, a.String())
+			}
+			return true
+		})
+		assert.Equal(t, covered.NumAddresses(), total)
+		assert.Equal(t, table.trie.NumAddresses(), total)
+	})
+}
+
+func TestTableEffectiveSets(t *testing.T) {
+	t.Run("empty", func(t *testing.T) {
+		assert.Nil(t, TableX{}.EffectiveSets())
+	})
+
+	t.Run("example", func(t *testing.T) {
+		m := NewTableX_()
+		m.Insert(_p("10.0.0.0/22"), "a")
+		m.Insert(_p("10.0.1.0/24"), "b")
+		m.Insert(_p("10.0.2.0/24"), "a")
+		m.Insert(_p("10.0.2.0/25"), "c")
+		m.Insert(_p("10.0.2.128/25"), "c")
+		m.Insert(_p("10.1.0.0/16"), "b")
+
+		sets := m.Table().EffectiveSets()
+		require.Len(t, sets, 3)
+		assert.Equal(t, "a", sets[0].Value)
+		assert.Equal(t, "[10.0.0.0/24, 10.0.3.0/24]", sets[0].Set.String())
+		assert.Equal(t, "b", sets[1].Value)
+		assert.Equal(t, "[10.0.1.0/24, 10.1.0.0/16]", sets[1].Set.String())
+		assert.Equal(t, "c", sets[2].Value)
+		assert.Equal(t, "[10.0.2.0/24]", sets[2].Set.String())
+	})
+
+	t.Run("comparator", func(t *testing.T) {
+		m := NewTableX_()
+		m.Insert(_p("10.0.0.0/24"), []int{1})
+		m.Insert(_p("10.0.2.0/24"), []int{1})
+		m.Insert(_p("10.0.1.0/24"), []int{2})
+
+		table := m.Table()
+		table.eq = func(a, b interface{}) bool {
+			return a.([]int)[0] == b.([]int)[0]
+		}
+		sets := table.EffectiveSets()
+		require.Len(t, sets, 2)
+		assert.Equal(t, "[10.0.0.0/24, 10.0.2.0/24]", sets[0].Set.String())
+		assert.Equal(t, "[10.0.1.0/24]", sets[1].Set.String())
+	})
+
+	t.Run("random", func(t *testing.T) {
+		r := rand.New(rand.NewSource(49))
+		m := NewTableX_()
+		for _, p := range randomPrefixes(r, 1000) {
+			m.InsertOrUpdate(p, r.Intn(5))
+		}
+		table := m.Table()
+
+		// The sets are disjoint and cover every address matched by the table
+		var union Set
+		var total int64
+		for _, s := range table.EffectiveSets() {
+			assert.True(t, s.Set.isValid())
+			union = union.Union(s.Set)
+			total += s.Set.NumAddresses()
+			for i := int64(0); i < 20; i++ {
+				address, _ := s.Set.Nth(r.Int63n(s.Set.NumAddresses()))
+				value, _, _ := table.LongestMatch(address)
+				assert.Equal(t, s.Value, value)
+			}
+		}
+		assert.Equal(t, total, union.NumAddresses())
+		assert.Equal(t, table.trie.NumAddresses(), total)
+	})
+}
+
 func ieq(a, b interface{}) bool {
 	return a == b
 }
@@ -629,6 +851,108 @@ func TestTableConcurrentModification(t *testing.T) {
 	assert.Equal(t, 1, panicked)
 }
 
+func TestTableOptimisticConcurrentModification(t *testing.T) {
+	m := NewTableX_().Optimistic()
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 64; j++ {
+				m.Insert(Prefix{AddressFromBytes(10, byte(i), byte(j), 0), 24}, i)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(8*64), m.NumEntries())
+	assert.True(t, m.Table().trie.isValid())
+}
+
+func TestTableOptimisticRetry(t *testing.T) {
+	m := NewTableX_().Optimistic()
+
+	// Freeze one modification in the middle and make another. The first is
+	// retried against the result of the second rather than panicking.
+	var calls int
+	ch := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		m.mutate(func() (bool, *trieNode) {
+			calls++
+			if calls == 1 {
+				ch <- true
+				<-ch
+			}
+			newHead, _ := m.root().Insert(_p("10.0.0.0/24"), nil)
+			return true, newHead
+		})
+		done <- true
+	}()
+	<-ch
+	m.Insert(_p("10.0.1.0/24"), nil)
+	ch <- true
+	<-done
+
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, int64(2), m.NumEntries())
+}
+
+func TestTableTransact(t *testing.T) {
+	m := NewTableX_()
+	m.Insert(_p("10.0.0.0/24"), 1)
+
+	committed := m.Transact(func(t_ TableX_) bool {
+		t_.Insert(_p("10.0.1.0/24"), 2)
+		t_.Update(_p("10.0.0.0/24"), 3)
+
+		// Changes are not visible until the transaction commits
+		assert.Equal(t, int64(1), m.NumEntries())
+		return true
+	})
+	assert.True(t, committed)
+	assert.Equal(t, int64(2), m.NumEntries())
+	value, _ := m.Get(_p("10.0.0.0/24"))
+	assert.Equal(t, 3, value)
+
+	before := m.Table()
+	committed = m.Transact(func(t_ TableX_) bool {
+		t_.Remove(_p("10.0.0.0/24"))
+		t_.Remove(_p("10.0.1.0/24"))
+		return false
+	})
+	assert.False(t, committed)
+	assert.True(t, before.trie == m.Table().trie)
+
+	assert.Panics(t, func() {
+		TableX_{}.Transact(func(TableX_) bool { return true })
+	})
+}
+
+func TestTableOptimisticTransact(t *testing.T) {
+	m := NewTableX_().Optimistic()
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 32; j++ {
+				m.Transact(func(t_ TableX_) bool {
+					// Both entries appear together or not at all
+					t_.Insert(Prefix{AddressFromBytes(10, byte(i), byte(j), 0), 24}, i)
+					t_.Insert(Prefix{AddressFromBytes(10, byte(i), byte(j), 0), 25}, i)
+					return true
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(8*32*2), m.NumEntries())
+}
+
 func TestNilTableX(t *testing.T) {
 	var table TableX_
 
@@ -961,3 +1285,285 @@ func TestTableXVariousComparators(t *testing.T) {
 		})
 	}
 }
+
+func TestTableXFilter(t *testing.T) {
+	var a TableX
+	assert.Equal(t, a, a.Filter(nil))
+
+	a = TableX{}.Build(func(a_ TableX_) bool {
+		a_.Insert(_p("203.0.113.0/27"), 1)
+		a_.Insert(_p("203.0.113.64/27"), 2)
+		a_.Insert(_p("203.0.113.0/25"), 3)
+		return true
+	})
+
+	var visited []Prefix
+	result := a.Filter(func(p Prefix, value interface{}) bool {
+		visited = append(visited, p)
+		return value.(int) != 3
+	})
+	assert.Equal(t, []Prefix{
+		_p("203.0.113.0/25"),
+		_p("203.0.113.0/27"),
+		_p("203.0.113.64/27"),
+	}, visited)
+
+	assert.Equal(t, int64(3), a.NumEntries())
+	assert.Equal(t, int64(2), result.NumEntries())
+	_, ok := result.Get(_p("203.0.113.0/25"))
+	assert.False(t, ok)
+	value, ok := result.Get(_p("203.0.113.64/27"))
+	assert.True(t, ok)
+	assert.Equal(t, 2, value)
+}
+
+func TestTableXRestrictExclude(t *testing.T) {
+	a := TableX{}.Build(func(a_ TableX_) bool {
+		a_.Insert(_p("10.0.0.0/8"), 1)
+		a_.Insert(_p("10.224.0.0/16"), 2)
+		a_.Insert(_p("10.224.24.0/24"), 3)
+		a_.Insert(_p("192.168.0.0/16"), 4)
+		return true
+	})
+
+	keys := func(table TableX) []string {
+		result := []string{}
+		table.Walk(func(p Prefix, _ interface{}) bool {
+			result = append(result, p.String())
+			return true
+		})
+		return result
+	}
+
+	set := _p("10.224.0.0/12").Set().Union(_p("192.168.0.0/17"))
+
+	assert.Equal(t, []string{"10.224.0.0/16", "10.224.24.0/24"}, keys(a.Restrict(set)))
+	assert.Equal(t, []string{"10.0.0.0/8", "192.168.0.0/16"}, keys(a.Exclude(set)))
+
+	assert.Equal(t, []string{}, keys(a.Restrict(nil)))
+	assert.Equal(t, keys(a), keys(a.Exclude(nil)))
+	assert.Equal(t, keys(a), keys(a.Restrict(Prefix{})))
+	assert.Equal(t, []string{}, keys(a.Exclude(Prefix{})))
+}
+
+func TestTableXRemoveSet(t *testing.T) {
+	tests := []struct {
+		desc    string
+		entries map[string]int
+		hole    SetI
+		keys    []string
+	}{
+		{
+			desc: "empty",
+			hole: _p("10.0.0.0/24"),
+			keys: []string{},
+		}, {
+			desc: "nil_hole",
+			entries: map[string]int{
+				"10.0.0.0/22": 1,
+			},
+			keys: []string{"10.0.0.0/22"},
+		}, {
+			desc: "disjoint",
+			entries: map[string]int{
+				"10.0.0.0/23": 1,
+			},
+			hole: _p("10.0.2.0/24"),
+			keys: []string{"10.0.0.0/23"},
+		}, {
+			desc: "contained",
+			entries: map[string]int{
+				"10.0.0.0/22":  1,
+				"10.0.1.0/24":  2,
+				"10.0.1.16/28": 3,
+			},
+			hole: _p("10.0.1.0/24"),
+			keys: []string{"10.0.0.0/24", "10.0.2.0/23"},
+		}, {
+			desc: "split_nested",
+			entries: map[string]int{
+				"10.0.0.0/22": 1,
+				"10.0.0.0/23": 2,
+				"10.0.2.0/24": 3,
+			},
+			hole: _r(_a("10.0.1.128"), _a("10.0.2.127")),
+			keys: []string{
+				"10.0.0.0/24",
+				"10.0.1.0/25",
+				"10.0.2.128/25",
+				"10.0.3.0/24",
+			},
+		}, {
+			desc: "existing_key_wins",
+			entries: map[string]int{
+				"10.0.0.0/22": 1,
+				"10.0.2.0/23": 2,
+			},
+			hole: _p("10.0.0.0/23"),
+			keys: []string{"10.0.2.0/23"},
+		}, {
+			desc: "multiple_holes",
+			entries: map[string]int{
+				"10.0.0.0/22":   1,
+				"10.0.1.64/26":  2,
+				"10.0.3.255/32": 3,
+			},
+			hole: _p("10.0.1.64/27").Set().Union(_p("10.0.2.0/24")).Union(_a("10.0.3.255")),
+			keys: []string{
+				"10.0.0.0/24",
+				"10.0.1.0/26",
+				"10.0.1.96/27",
+				"10.0.1.128/25",
+				"10.0.3.0/25",
+				"10.0.3.128/26",
+				"10.0.3.192/27",
+				"10.0.3.224/28",
+				"10.0.3.240/29",
+				"10.0.3.248/30",
+				"10.0.3.252/31",
+				"10.0.3.254/32",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			original := TableX{}.Build(func(t_ TableX_) bool {
+				for p, v := range tt.entries {
+					t_.Insert(_p(p), v)
+				}
+				return true
+			})
+
+			result := original.RemoveSet(tt.hole)
+			assert.True(t, result.trie.isValid())
+
+			keys := []string{}
+			result.Walk(func(p Prefix, _ interface{}) bool {
+				keys = append(keys, p.String())
+				return true
+			})
+			assert.Equal(t, tt.keys, keys)
+
+			hole := Set{}
+			if tt.hole != nil {
+				hole = tt.hole.Set()
+			}
+			_p("10.0.0.0/22").walkAddresses(func(a Address) bool {
+				value, found, _ := result.LongestMatch(a)
+				if hole.Contains(a) {
+					assert.False(t, found, a.String())
+				} else {
+					expected, expectedFound, _ := original.LongestMatch(a)
+					assert.Equal(t, expectedFound, found, a.String())
+					assert.Equal(t, expected, value, a.String())
+				}
+				return true
+			})
+
+			mutable := original.Table_()
+			mutable.RemoveSet(tt.hole)
+			assert.True(t, mutable.Table().trie.Equal(result.trie, ieq))
+		})
+	}
+}
+
+func TestTableXRemoveSetLarge(t *testing.T) {
+	r := rand.New(rand.NewSource(27))
+	m := NewTableX_()
+	for _, p := range randomPrefixes(r, 10000) {
+		m.InsertOrUpdate(p, p.Length())
+	}
+	table := m.Table()
+
+	// Punching out one address only visits the entries around it. Most of
+	// the allocations are for splitting the entries that contain it.
+	hole := Address{r.Uint32()}
+	assert.Less(t, testing.AllocsPerRun(10, func() {
+		table.RemoveSet(hole)
+	}), float64(table.NumEntries())/10)
+
+	// Every other address in a /24, which is stored as a bitmap, plus some
+	// random prefixes
+	s := NewSet_()
+	for i := 0; i < 256; i += 2 {
+		s.Insert(Address{0x0a000000 + uint32(i)})
+	}
+	for _, p := range randomPrefixes(r, 100) {
+		s.Insert(p)
+	}
+	for _, h := range []Set{hole.Set(), s.Set()} {
+		result := table.RemoveSet(h)
+		assert.True(t, result.trie.isValid())
+		EffectiveDiff(table, result, func(rng Range, _, _ interface{}, _, rok bool) bool {
+			assert.False(t, rok, rng.String())
+			assert.True(t, h.Contains(rng), rng.String())
+			return true
+		})
+		h.WalkRanges(func(rng Range) bool {
+			_, found, _ := result.LongestMatch(rng.first)
+			assert.False(t, found)
+			return true
+		})
+	}
+}
+
+func TestTableXNthEntryRank(t *testing.T) {
+	m := NewTableX_()
+	for i, p := range []string{"10.0.0.0/8", "10.0.0.0/16", "10.0.0.0/24", "10.1.0.0/16", "10.224.0.0/24", "192.168.0.0/24"} {
+		m.Insert(_p(p), i)
+	}
+	table := m.Table()
+
+	var i int64
+	table.Walk(func(p Prefix, value interface{}) bool {
+		prefix, v, found := table.NthEntry(i)
+		assert.True(t, found)
+		assert.Equal(t, p, prefix)
+		assert.Equal(t, value, v)
+		assert.Equal(t, i, table.Rank(p))
+		i++
+		return true
+	})
+	assert.Equal(t, table.NumEntries(), i)
+
+	_, _, found := table.NthEntry(-1)
+	assert.False(t, found)
+	_, _, found = table.NthEntry(i)
+	assert.False(t, found)
+
+	// Prefixes not in the table
+	assert.Equal(t, int64(0), table.Rank(_p("0.0.0.0/0")))
+	assert.Equal(t, int64(0), table.Rank(_p("9.0.0.0/8")))
+	assert.Equal(t, int64(1), table.Rank(_p("10.0.0.0/12")))
+	assert.Equal(t, int64(3), table.Rank(_p("10.0.1.0/24")))
+	assert.Equal(t, int64(4), table.Rank(_p("10.128.0.0/9")))
+	assert.Equal(t, int64(5), table.Rank(_p("10.255.0.0/16")))
+	assert.Equal(t, int64(6), table.Rank(_p("255.0.0.0/8")))
+	assert.Equal(t, int64(0), TableX{}.Rank(_p("10.0.0.0/8")))
+}
+
+func TestTableXWalkReverse(t *testing.T) {
+	m := NewTableX_()
+	for i, p := range []string{"10.0.0.0/8", "10.0.0.0/16", "10.0.0.0/24", "10.1.0.0/16", "192.168.0.0/24"} {
+		m.Insert(_p(p), i)
+	}
+
+	var forward, reverse []Prefix
+	m.Table().Walk(func(p Prefix, _ interface{}) bool {
+		forward = append([]Prefix{p}, forward...)
+		return true
+	})
+	assert.True(t, m.Table().WalkReverse(func(p Prefix, _ interface{}) bool {
+		reverse = append(reverse, p)
+		return true
+	}))
+	assert.Equal(t, forward, reverse)
+
+	var count int
+	assert.False(t, m.Table().WalkReverse(func(p Prefix, _ interface{}) bool {
+		count++
+		return count < 2
+	}))
+	assert.Equal(t, 2, count)
+}
@@ -24,3 +24,23 @@ func swapSetNodePtr(ptr **setNode, old, new *setNode) bool {
 		unsafe.Pointer(new),
 	)
 }
+
+func loadTrieNodePtr(ptr **trieNode) *trieNode {
+	return (*trieNode)(
+		atomic.LoadPointer(
+			(*unsafe.Pointer)(
+				unsafe.Pointer(ptr),
+			),
+		),
+	)
+}
+
+func loadSetNodePtr(ptr **setNode) *setNode {
+	return (*setNode)(
+		atomic.LoadPointer(
+			(*unsafe.Pointer)(
+				unsafe.Pointer(ptr),
+			),
+		),
+	)
+}